@@ -0,0 +1,397 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDescription is written by git init into the description file
+const defaultDescription = "Unnamed repository;"
+
+// Admin is an http.Handler with JSON API for repository management:
+//
+//	GET    /repos         List repositories, optionally filtered by ?namespace=
+//	POST   /repos         Create a repository
+//	GET    /repos/{name}  Show a repository
+//	PATCH  /repos/{name}  Rename a repository or change its settings
+//	DELETE /repos/{name}  Delete a repository
+//
+// Mount it with http.StripPrefix to serve under a different path.
+type Admin struct {
+	config   Config
+	AuthFunc func(Credential, *http.Request) (bool, error) // Required, all requests are rejected without it
+}
+
+type adminRepo struct {
+	Name          string    `json:"name"`
+	Namespace     string    `json:"namespace"`
+	Description   string    `json:"description"`
+	DefaultBranch string    `json:"default_branch"`
+	Size          int64     `json:"size"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type adminRepoRequest struct {
+	Name          string  `json:"name"`
+	Description   *string `json:"description"`
+	DefaultBranch string  `json:"default_branch"`
+	Hooks         bool    `json:"hooks"`
+}
+
+type adminError struct {
+	Message string `json:"message"`
+}
+
+func NewAdmin(cfg Config) *Admin {
+	// Use PATH if full path is not specified
+	if cfg.GitPath == "" {
+		cfg.GitPath = "git"
+	}
+	return &Admin{config: cfg}
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := withFields(a.config.logger(), "remote_addr", r.RemoteAddr)
+	log.Info("admin: request", "method", r.Method, "url", r.URL.String())
+
+	cred, err := getCredential(r)
+	if err != nil {
+		requestCredentials(w)
+		return
+	}
+
+	if a.AuthFunc == nil {
+		writeAdminJSON(w, http.StatusForbidden, adminError{"admin API is disabled"})
+		return
+	}
+
+	allowed, err := a.AuthFunc(cred, r)
+	if err != nil {
+		log.Error("admin: auth", "error", err)
+	}
+	if !allowed || err != nil {
+		writeAdminJSON(w, http.StatusForbidden, adminError{"access denied"})
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "repos" && r.Method == http.MethodGet:
+		a.listRepos(w, r)
+	case path == "repos" && r.Method == http.MethodPost:
+		a.createRepo(w, r)
+	case strings.HasPrefix(path, "repos/"):
+		name := strings.TrimPrefix(path, "repos/")
+		switch r.Method {
+		case http.MethodGet:
+			a.getRepo(w, r, name)
+		case http.MethodPatch:
+			a.updateRepo(w, r, name)
+		case http.MethodDelete:
+			a.deleteRepo(w, r, name)
+		default:
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+		}
+	default:
+		writeAdminJSON(w, http.StatusNotFound, adminError{"not found"})
+	}
+}
+
+func (a *Admin) listRepos(w http.ResponseWriter, r *http.Request) {
+	namespace := strings.Trim(r.URL.Query().Get("namespace"), "/")
+	repos := []adminRepo{}
+
+	resolver := a.config.resolver()
+	lister, ok := resolver.(RepoLister)
+	if !ok {
+		writeAdminJSON(w, http.StatusNotImplemented, adminError{"repository resolver does not support listing"})
+		return
+	}
+
+	names, err := lister.List()
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	for _, name := range names {
+		path, err := resolver.Resolve(name)
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+
+		repo, err := readAdminRepo(name, path)
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+		if namespace == "" || repo.Namespace == namespace || strings.HasPrefix(repo.Namespace, namespace+"/") {
+			repos = append(repos, repo)
+		}
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	writeAdminJSON(w, http.StatusOK, repos)
+}
+
+func (a *Admin) createRepo(w http.ResponseWriter, r *http.Request) {
+	req := adminRepoRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{"invalid request body"})
+		return
+	}
+
+	name, path, ok := a.resolve(w, req.Name)
+	if !ok {
+		return
+	}
+
+	if repoExists(path) {
+		writeAdminJSON(w, http.StatusConflict, adminError{"repository already exists"})
+		return
+	}
+
+	if parent := a.parentRepo(name); parent != "" {
+		writeAdminJSON(w, http.StatusConflict, adminError{"repository is inside of " + parent})
+		return
+	}
+
+	if req.DefaultBranch != "" && !a.validBranch(req.DefaultBranch) {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{"invalid default branch"})
+		return
+	}
+
+	if err := initRepo(path, &a.config); err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	if req.Hooks {
+		scripts, err := a.config.hookScripts()
+		if err == nil {
+			err = scripts.setupInDir(path)
+		}
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+	}
+
+	if err := a.configureRepo(path, req); err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.writeRepo(w, http.StatusCreated, name, path)
+}
+
+func (a *Admin) getRepo(w http.ResponseWriter, r *http.Request, name string) {
+	name, path, ok := a.resolveExisting(w, name)
+	if !ok {
+		return
+	}
+	a.writeRepo(w, http.StatusOK, name, path)
+}
+
+func (a *Admin) updateRepo(w http.ResponseWriter, r *http.Request, name string) {
+	req := adminRepoRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{"invalid request body"})
+		return
+	}
+
+	name, path, ok := a.resolveExisting(w, name)
+	if !ok {
+		return
+	}
+
+	if req.DefaultBranch != "" && !a.validBranch(req.DefaultBranch) {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{"invalid default branch"})
+		return
+	}
+
+	if req.Name != "" && req.Name != name {
+		newName, newPath, ok := a.resolve(w, req.Name)
+		if !ok {
+			return
+		}
+
+		if fileExists(newPath) {
+			writeAdminJSON(w, http.StatusConflict, adminError{"repository already exists"})
+			return
+		}
+
+		if parent := a.parentRepo(newName); parent != "" {
+			writeAdminJSON(w, http.StatusConflict, adminError{"repository is inside of " + parent})
+			return
+		}
+
+		if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+			a.fail(w, err)
+			return
+		}
+
+		if err := os.Rename(path, newPath); err != nil {
+			a.fail(w, err)
+			return
+		}
+
+		a.config.logger().Info("admin: repository renamed", "repo", name, "new_name", newName)
+		name, path = newName, newPath
+	}
+
+	if err := a.configureRepo(path, req); err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.writeRepo(w, http.StatusOK, name, path)
+}
+
+func (a *Admin) deleteRepo(w http.ResponseWriter, r *http.Request, name string) {
+	name, path, ok := a.resolveExisting(w, name)
+	if !ok {
+		return
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.config.logger().Info("admin: repository deleted", "repo", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolve validates the repository name and returns its final name and path
+func (a *Admin) resolve(w http.ResponseWriter, name string) (string, string, bool) {
+	if err := a.config.RepoNames.Validate(name); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{err.Error()})
+		return "", "", false
+	}
+
+	name, path, err := resolveRepo(a.config.resolver(), a.config.RepoNames, name)
+	if err != nil {
+		if errors.Is(err, ErrRepoNotFound) {
+			writeAdminJSON(w, http.StatusNotFound, adminError{err.Error()})
+		} else {
+			a.fail(w, err)
+		}
+		return "", "", false
+	}
+
+	return name, path, true
+}
+
+// resolveExisting is like resolve, but responds with 404 if repository does not exist
+func (a *Admin) resolveExisting(w http.ResponseWriter, name string) (string, string, bool) {
+	name, path, ok := a.resolve(w, name)
+	if ok && !repoExists(path) {
+		writeAdminJSON(w, http.StatusNotFound, adminError{ErrRepoNotFound.Error()})
+		return "", "", false
+	}
+	return name, path, ok
+}
+
+// parentRepo returns name of an existing repository the named one would be
+// nested in. Such repositories are not listed and break their parents.
+func (a *Admin) parentRepo(name string) string {
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		parent := strings.Join(segments[:i], "/")
+		if _, path, err := resolveRepo(a.config.resolver(), a.config.RepoNames, parent); err == nil && repoExists(path) {
+			return parent
+		}
+	}
+	return ""
+}
+
+// validBranch checks whether the name could be used for a branch
+func (a *Admin) validBranch(branch string) bool {
+	return exec.Command(a.config.GitPath, "check-ref-format", "refs/heads/"+branch).Run() == nil
+}
+
+// configureRepo applies description and default branch from the request
+func (a *Admin) configureRepo(path string, req adminRepoRequest) error {
+	if req.Description != nil {
+		if err := ioutil.WriteFile(filepath.Join(path, "description"), []byte(*req.Description+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if req.DefaultBranch != "" {
+		out, err := exec.Command(a.config.GitPath, "-C", path, "symbolic-ref", "HEAD", "refs/heads/"+req.DefaultBranch).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("cant set default branch: %s", out)
+		}
+	}
+
+	return nil
+}
+
+func (a *Admin) writeRepo(w http.ResponseWriter, status int, name string, path string) {
+	repo, err := readAdminRepo(name, path)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeAdminJSON(w, status, repo)
+}
+
+func (a *Admin) fail(w http.ResponseWriter, err error) {
+	a.config.logger().Error("admin: request failed", "error", err)
+	writeAdminJSON(w, http.StatusInternalServerError, adminError{"internal server error"})
+}
+
+// readAdminRepo collects repository details from its directory
+func readAdminRepo(name string, path string) (adminRepo, error) {
+	namespace, _ := getNamespaceAndRepo(name)
+	repo := adminRepo{Name: name, Namespace: namespace}
+
+	if data, err := ioutil.ReadFile(filepath.Join(path, "description")); err == nil {
+		description := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(description, defaultDescription) {
+			repo.Description = description
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(path, "HEAD")); err == nil {
+		repo.DefaultBranch = strings.TrimPrefix(strings.TrimSpace(string(data)), "ref: refs/heads/")
+	}
+
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		// Pushes remove temporary files and quarantine directories while we walk
+		if os.IsNotExist(err) && name != path {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			repo.Size += info.Size()
+		}
+		if info.ModTime().After(repo.UpdatedAt) {
+			repo.UpdatedAt = info.ModTime()
+		}
+		return nil
+	})
+	repo.UpdatedAt = repo.UpdatedAt.UTC().Truncate(time.Second)
+
+	return repo, err
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,175 @@
+package gitkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminCall sends a request to the admin API and decodes the response into v
+func adminCall(t *testing.T, url string, method string, path string, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	dir := t.TempDir()
+	admin := NewAdmin(Config{
+		Dir:    dir,
+		Hooks:  &HookScripts{PreReceive: "#!/bin/sh\nexit 0\n"},
+		Logger: testLogger,
+	})
+	admin.AuthFunc = func(cred Credential, r *http.Request) (bool, error) {
+		return cred.Username == "admin" && cred.Password == "secret", nil
+	}
+	ts := httptest.NewServer(admin)
+	defer ts.Close()
+
+	repo := adminRepo{}
+	status := adminCall(t, ts.URL, "POST", "/repos", `{"name":"org/app.git","description":"My app","default_branch":"main","hooks":true}`, &repo)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "org/app.git", repo.Name)
+	assert.Equal(t, "org", repo.Namespace)
+	assert.Equal(t, "My app", repo.Description)
+	assert.Equal(t, "main", repo.DefaultBranch)
+	assert.NotZero(t, repo.Size)
+	assert.NotZero(t, repo.UpdatedAt)
+	assert.FileExists(t, filepath.Join(dir, "org", "app.git", "hooks", "pre-receive"))
+
+	status = adminCall(t, ts.URL, "POST", "/repos", `{"name":"org/app.git"}`, nil)
+	assert.Equal(t, http.StatusConflict, status)
+
+	status = adminCall(t, ts.URL, "POST", "/repos", `{"name":"../evil.git"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status = adminCall(t, ts.URL, "POST", "/repos", `{"name":"bad.git","default_branch":"a..b"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	require.Equal(t, http.StatusCreated, adminCall(t, ts.URL, "POST", "/repos", `{"name":"tools.git"}`, nil))
+
+	// Repositories could not be nested
+	status = adminCall(t, ts.URL, "POST", "/repos", `{"name":"tools.git/x.git"}`, nil)
+	assert.Equal(t, http.StatusConflict, status)
+	status = adminCall(t, ts.URL, "PATCH", "/repos/org/app.git", `{"name":"tools.git/x.git"}`, nil)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.NoDirExists(t, filepath.Join(dir, "tools.git", "x.git"))
+
+	repos := []adminRepo{}
+	require.Equal(t, http.StatusOK, adminCall(t, ts.URL, "GET", "/repos", "", &repos))
+	require.Len(t, repos, 2)
+	assert.Equal(t, "org/app.git", repos[0].Name)
+	assert.Equal(t, "tools.git", repos[1].Name)
+	assert.Equal(t, "", repos[1].Description)
+	assert.NotEmpty(t, repos[1].DefaultBranch)
+
+	require.Equal(t, http.StatusOK, adminCall(t, ts.URL, "GET", "/repos?namespace=org", "", &repos))
+	require.Len(t, repos, 1)
+	assert.Equal(t, "org/app.git", repos[0].Name)
+
+	status = adminCall(t, ts.URL, "PATCH", "/repos/org/app.git", `{"name":"team/app.git","description":"Renamed"}`, &repo)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "team/app.git", repo.Name)
+	assert.Equal(t, "Renamed", repo.Description)
+	assert.DirExists(t, filepath.Join(dir, "team", "app.git"))
+	assert.NoDirExists(t, filepath.Join(dir, "org", "app.git"))
+
+	status = adminCall(t, ts.URL, "PATCH", "/repos/team/app.git", `{"name":"tools.git"}`, nil)
+	assert.Equal(t, http.StatusConflict, status)
+
+	assert.Equal(t, http.StatusNotFound, adminCall(t, ts.URL, "GET", "/repos/org/app.git", "", nil))
+	assert.Equal(t, http.StatusOK, adminCall(t, ts.URL, "GET", "/repos/team/app.git", "", nil))
+
+	assert.Equal(t, http.StatusNoContent, adminCall(t, ts.URL, "DELETE", "/repos/team/app.git", "", nil))
+	assert.NoDirExists(t, filepath.Join(dir, "team", "app.git"))
+	assert.Equal(t, http.StatusNotFound, adminCall(t, ts.URL, "DELETE", "/repos/team/app.git", "", nil))
+}
+
+// bucketResolver is a sharded resolver that could list its repositories
+type bucketResolver struct {
+	RepoResolver
+	dir string
+}
+
+func (b bucketResolver) List() ([]string, error) {
+	buckets, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, bucket := range buckets {
+		list, err := DirResolver{Dir: filepath.Join(b.dir, bucket.Name())}.List()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, list...)
+	}
+	return names, nil
+}
+
+func TestAdmin_Resolver(t *testing.T) {
+	dir := t.TempDir()
+	admin := NewAdmin(Config{Resolver: bucketResolver{shardedResolver(dir), dir}, Logger: testLogger})
+	admin.AuthFunc = func(cred Credential, r *http.Request) (bool, error) {
+		return true, nil
+	}
+	ts := httptest.NewServer(admin)
+	t.Cleanup(ts.Close)
+
+	require.Equal(t, http.StatusCreated, adminCall(t, ts.URL, "POST", "/repos", `{"name":"org/app.git"}`, nil))
+	require.Equal(t, http.StatusCreated, adminCall(t, ts.URL, "POST", "/repos", `{"name":"tools.git"}`, nil))
+
+	repos := []adminRepo{}
+	require.Equal(t, http.StatusOK, adminCall(t, ts.URL, "GET", "/repos", "", &repos))
+	require.Len(t, repos, 2)
+	assert.Equal(t, "org/app.git", repos[0].Name)
+	assert.Equal(t, "tools.git", repos[1].Name)
+
+	// Resolvers without listing support
+	admin.config.Resolver = shardedResolver(dir)
+	assert.Equal(t, http.StatusNotImplemented, adminCall(t, ts.URL, "GET", "/repos", "", nil))
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	admin := NewAdmin(Config{Dir: t.TempDir(), Logger: testLogger})
+
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/repos", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	req := httptest.NewRequest("GET", "/repos", nil)
+	req.SetBasicAuth("admin", "secret")
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	admin.AuthFunc = func(cred Credential, r *http.Request) (bool, error) {
+		return cred.Password == "other", nil
+	}
+	req = httptest.NewRequest("POST", "/repos", bytes.NewBufferString(`{"name":"test.git"}`))
+	req.SetBasicAuth("admin", "secret")
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, req)
+	body, _ := ioutil.ReadAll(recorder.Body)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, string(body), "access denied")
+	assert.False(t, repoExists(filepath.Join(admin.config.Dir, "test.git")))
+}
@@ -0,0 +1,62 @@
+package gitkit
+
+// Git services that could be requested by clients
+const (
+	ServiceUploadPack    = "upload-pack"
+	ServiceReceivePack   = "receive-pack"
+	ServiceUploadArchive = "upload-archive"
+)
+
+// Identity describes who is accessing a repository
+type Identity struct {
+	Username string // Authenticated HTTP user, or owner of SSH key
+	KeyID    string // Authenticated SSH public key id
+}
+
+// IsAnonymous returns true if the identity has not been authenticated
+func (i Identity) IsAnonymous() bool {
+	return i.Username == "" && i.KeyID == ""
+}
+
+// key returns a unique identity key, empty for anonymous access
+func (i Identity) key() string {
+	if i.Username != "" {
+		return "user:" + i.Username
+	}
+	if i.KeyID != "" {
+		return "key:" + i.KeyID
+	}
+	return ""
+}
+
+// Authorizer decides whether an identity is allowed to run a git service on
+// a repository. It's used by both HTTP and SSH servers.
+type Authorizer interface {
+	Authorize(identity Identity, repo string, service string) (bool, error)
+}
+
+// AuthorizerFunc is an adapter to use ordinary functions as Authorizer
+type AuthorizerFunc func(identity Identity, repo string, service string) (bool, error)
+
+// Authorize calls f(identity, repo, service)
+func (f AuthorizerFunc) Authorize(identity Identity, repo string, service string) (bool, error) {
+	return f(identity, repo, service)
+}
+
+// rpcService returns the git service for a command in either "git-upload-pack"
+// or "git upload-pack" form. Unknown commands are treated as upload-pack.
+func rpcService(rpc string) string {
+	switch service := subCommand(rpc); service {
+	case ServiceReceivePack, ServiceUploadArchive:
+		return service
+	}
+	return ServiceUploadPack
+}
+
+// serviceOperation returns the kind of access required by a git service
+func serviceOperation(service string) Operation {
+	if service == ServiceReceivePack {
+		return WriteOperation
+	}
+	return ReadOperation
+}
@@ -0,0 +1,70 @@
+package gitkit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readOnlyAuthorizer denies pushes for anonymous users
+var readOnlyAuthorizer = AuthorizerFunc(func(identity Identity, repo string, service string) (bool, error) {
+	return !identity.IsAnonymous() || service != ServiceReceivePack, nil
+})
+
+func TestIdentity_IsAnonymous(t *testing.T) {
+	assert.True(t, Identity{}.IsAnonymous())
+	assert.False(t, Identity{Username: "hello"}.IsAnonymous())
+	assert.False(t, Identity{KeyID: "12345"}.IsAnonymous())
+}
+
+func Test_serviceOperation(t *testing.T) {
+	assert.Equal(t, ReadOperation, serviceOperation(ServiceUploadPack))
+	assert.Equal(t, ReadOperation, serviceOperation(ServiceUploadArchive))
+	assert.Equal(t, WriteOperation, serviceOperation(ServiceReceivePack))
+}
+
+func Test_rpcService(t *testing.T) {
+	assert.Equal(t, ServiceUploadPack, rpcService("git-upload-pack"))
+	assert.Equal(t, ServiceReceivePack, rpcService("git receive-pack"))
+	assert.Equal(t, ServiceUploadArchive, rpcService("git-upload-archive"))
+	assert.Equal(t, ServiceUploadPack, rpcService(""))
+}
+
+func TestAuthorizerHTTP(t *testing.T) {
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--bare", "test.git")
+
+	_, ts := newTestServer(t, Config{Dir: dir}, func(s *Server) {
+		s.Authorizer = readOnlyAuthorizer
+	})
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, nil, "push", ts.URL+"/test.git", "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "403")
+
+	_, stderr, err = runGit(t, work, nil, "ls-remote", ts.URL+"/test.git")
+	assert.NoError(t, err, stderr)
+}
+
+func TestAuthorizerSSH(t *testing.T) {
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--bare", "test.git")
+
+	_, port := newTestSSH(t, Config{Dir: dir}, func(s *SSH) {
+		s.Authorizer = readOnlyAuthorizer
+	})
+
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Access denied.")
+
+	_, stderr, err = runGit(t, work, env, "ls-remote", url)
+	require.NoError(t, err, stderr)
+}
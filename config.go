@@ -4,17 +4,53 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
-	KeyDir     string       // Directory for server ssh keys. Only used in SSH strategy.
-	Dir        string       // Directory that contains repositories
-	GitPath    string       // Path to git binary
-	GitUser    string       // User for ssh connections
-	AutoCreate bool         // Automatically create repostories
-	AutoHooks  bool         // Automatically setup git hooks
-	Hooks      *HookScripts // Scripts for hooks/* directory
-	Auth       bool         // Require authentication
+	KeyDir         string                       // Directory for server ssh keys. Only used in SSH strategy.
+	Dir            string                       // Directory that contains repositories
+	GitPath        string                       // Path to git binary
+	GitUser        string                       // User for ssh connections
+	AutoCreate     bool                         // Automatically create repostories
+	AutoHooks      bool                         // Automatically setup git hooks
+	Hooks          *HookScripts                 // Scripts for hooks/* directory
+	HookCallbacks  *HookCallbacks               // Go functions called from hooks, take precedence over Hooks scripts
+	Auth           bool                         // Require authentication
+	AllowAnonymous bool                         // Pass requests without credentials to auth func with empty credential
+	DumbHTTP       bool                         // Serve read-only dumb HTTP protocol
+	LFS            bool                         // Serve Git LFS API, objects are stored in lfs directory of each repository
+	AllowedEnv     []string                     // Environment variables accepted from ssh clients, GIT_PROTOCOL is always accepted
+	Timeouts       Timeouts                     // Maximum runtime of git processes
+	Logger         Logger                       // Logger for server events, defaults to standard logger
+	Limits         Limits                       // Limits for concurrently running git processes
+	RepoNames      RepoNamePolicy               // Rules for repository names requested by clients
+	Resolver       RepoResolver                 // Maps repository names to paths, defaults to Dir based layout
+	Modes          *Modes                       // Read-only and maintenance modes, could be changed at runtime
+	RefPolicies    []RefPolicy                  // Checks for each pushed ref update, run before receive-pack
+	UploadPack     *UploadPackOptions           // Fetch features offered by upload-pack, git configuration decides if nil
+	RepoUploadPack map[string]UploadPackOptions // Per-repository upload-pack options, replace UploadPack
+}
+
+// Timeouts limits how long git processes are allowed to run per service.
+// Zero value means no limit.
+type Timeouts struct {
+	UploadPack    time.Duration
+	ReceivePack   time.Duration
+	UploadArchive time.Duration
+}
+
+// forService returns the timeout for a given git service
+func (t Timeouts) forService(rpc string) time.Duration {
+	switch subCommand(rpc) {
+	case ServiceUploadPack:
+		return t.UploadPack
+	case ServiceReceivePack:
+		return t.ReceivePack
+	case ServiceUploadArchive:
+		return t.UploadArchive
+	}
+	return 0
 }
 
 // HookScripts represents all repository server-size git hooks
@@ -53,7 +89,6 @@ func (c *HookScripts) setupInDir(path string) error {
 		}
 
 		if err := ioutil.WriteFile(fullPath, []byte(script), 0755); err != nil {
-			logError("hook-update", err)
 			return err
 		}
 	}
@@ -61,6 +96,20 @@ func (c *HookScripts) setupInDir(path string) error {
 	return nil
 }
 
+func (c *Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return defaultLogger
+}
+
+func (c *Config) resolver() RepoResolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return DirResolver{Dir: c.Dir}
+}
+
 func (c *Config) KeyPath() string {
 	return filepath.Join(c.KeyDir, "gitkit.rsa")
 }
@@ -72,14 +121,52 @@ func (c *Config) Setup() error {
 		}
 	}
 
-	if c.AutoHooks && c.Hooks != nil {
+	if c.AutoHooks && (c.Hooks != nil || c.HookCallbacks != nil) {
 		return c.setupHooks()
 	}
 
 	return nil
 }
 
+// hookScripts returns scripts to install into repositories, scripts calling
+// Go callbacks replace shell scripts of the same hooks.
+func (c *Config) hookScripts() (*HookScripts, error) {
+	scripts := &HookScripts{}
+	if c.Hooks != nil {
+		*scripts = *c.Hooks
+	}
+
+	if c.HookCallbacks == nil {
+		return scripts, nil
+	}
+
+	callbacks := map[string]*string{
+		"pre-receive":  &scripts.PreReceive,
+		"update":       &scripts.Update,
+		"post-receive": &scripts.PostReceive,
+	}
+
+	for hook, script := range callbacks {
+		if c.HookCallbacks.forHook(hook) == nil {
+			continue
+		}
+
+		content, err := callbackScript(hook)
+		if err != nil {
+			return nil, err
+		}
+		*script = content
+	}
+
+	return scripts, nil
+}
+
 func (c *Config) setupHooks() error {
+	scripts, err := c.hookScripts()
+	if err != nil {
+		return err
+	}
+
 	files, err := ioutil.ReadDir(c.Dir)
 	if err != nil {
 		return err
@@ -92,7 +179,7 @@ func (c *Config) setupHooks() error {
 
 		path := filepath.Join(c.Dir, file.Name())
 
-		if err := c.Hooks.setupInDir(path); err != nil {
+		if err := scripts.setupInDir(path); err != nil {
 			return err
 		}
 	}
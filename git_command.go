@@ -23,7 +23,11 @@ func ParseGitCommand(cmd string) (*GitCommand, error) {
 	result := &GitCommand{
 		Original: cmd,
 		Command:  matches[0][1],
-		Repo:     strings.Replace(matches[0][2], "/", "", 1),
+		Repo:     strings.TrimPrefix(matches[0][2], "/"),
+	}
+
+	if err := validateRepoPath(result.Repo); err != nil {
+		return nil, err
 	}
 
 	return result, nil
@@ -0,0 +1,319 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HookCall describes a git hook invocation passed to Go callbacks
+type HookCall struct {
+	Hook     string      // Hook name: pre-receive, update or post-receive
+	RepoName string      // Repository name as requested by the client
+	RepoPath string      // Repository path on disk
+	Updates  []*HookInfo // Ref updates from hook input, or arguments of update hook
+	Env      []string    // Environment of the hook process
+	Output   io.Writer   // Messages for the pushing client, shown as "remote:" lines
+	GitPath  string      // Git binary of the server, for git commands of the callback
+}
+
+// HookFunc is a Go hook callback. Returned error fails the hook and its
+// message is shown to the pushing client.
+type HookFunc func(call *HookCall) error
+
+// HookCallbacks are Go functions called from git hooks of repositories served
+// by a running server. Installed hook scripts execute the server binary, which
+// must call HookMain at the start of its main function.
+type HookCallbacks struct {
+	PreReceive  HookFunc
+	Update      HookFunc
+	PostReceive HookFunc
+}
+
+// forHook returns the callback for a git hook name
+func (c *HookCallbacks) forHook(hook string) HookFunc {
+	switch hook {
+	case "pre-receive":
+		return c.PreReceive
+	case "update":
+		return c.Update
+	case "post-receive":
+		return c.PostReceive
+	}
+	return nil
+}
+
+// hookRequest is sent by the hook process to the server
+type hookRequest struct {
+	Hook  string   `json:"hook"`
+	Args  []string `json:"args"`
+	Env   []string `json:"env"`
+	Dir   string   `json:"dir"`
+	Stdin string   `json:"stdin"`
+}
+
+// hookResponse is streamed back to the hook process, the last one is marked as done
+type hookResponse struct {
+	Output string `json:"output,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HookMain handles the execution of the program as a git hook installed for
+// HookCallbacks: it passes the hook to the running server and exits. It returns
+// immediately when the program is started normally.
+func HookMain() {
+	hook := os.Getenv("GITKIT_HOOK")
+	if hook == "" {
+		return
+	}
+	os.Exit(runHook(hook, os.Args[1:], os.Stdin, os.Stderr))
+}
+
+// runHook sends the hook call to the server and returns the hook exit code
+func runHook(hook string, args []string, stdin io.Reader, stderr io.Writer) int {
+	socket := os.Getenv("GITKIT_HOOK_SOCKET")
+	if socket == "" {
+		fmt.Fprintln(stderr, "gitkit: hook server is not available")
+		return 1
+	}
+
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, "gitkit: cant read hook input:", err)
+		return 1
+	}
+
+	dir, _ := os.Getwd()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		fmt.Fprintln(stderr, "gitkit: cant connect to hook server:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	req := hookRequest{Hook: hook, Args: args, Env: os.Environ(), Dir: dir, Stdin: string(input)}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		fmt.Fprintln(stderr, "gitkit: cant send hook request:", err)
+		return 1
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		resp := hookResponse{}
+		if err := decoder.Decode(&resp); err != nil {
+			fmt.Fprintln(stderr, "gitkit: hook server went away:", err)
+			return 1
+		}
+
+		if resp.Output != "" {
+			io.WriteString(stderr, resp.Output)
+		}
+
+		if resp.Done {
+			if resp.Error != "" {
+				fmt.Fprintln(stderr, resp.Error)
+				return 1
+			}
+			return 0
+		}
+	}
+}
+
+// hookServer serves hook calls from git processes over a unix socket
+type hookServer struct {
+	callbacks *HookCallbacks
+	gitPath   string
+	log       Logger
+
+	mu       sync.Mutex // Guards the socket, which is recreated after close
+	dir      string
+	listener net.Listener
+}
+
+func newHookServer(callbacks *HookCallbacks, gitPath string, log Logger) *hookServer {
+	return &hookServer{callbacks: callbacks, gitPath: gitPath, log: log}
+}
+
+// start creates the socket on first use, or first use after close, and
+// returns its address
+func (h *hookServer) start() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener != nil {
+		return h.listener.Addr().String(), nil
+	}
+
+	dir, err := ioutil.TempDir("", "gitkit-hooks-")
+	if err != nil {
+		return "", err
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "hooks.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	h.dir, h.listener = dir, listener
+	go h.serve(listener)
+
+	return listener.Addr().String(), nil
+}
+
+// env returns environment for git processes to reach the hook server
+func (h *hookServer) env() ([]string, error) {
+	if h == nil || h.callbacks == nil {
+		return nil, nil
+	}
+
+	addr, err := h.start()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{"GITKIT_HOOK_SOCKET=" + addr}, nil
+}
+
+// close removes the socket, next git process gets a new one
+func (h *hookServer) close() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener == nil {
+		return nil
+	}
+
+	err := h.listener.Close()
+	os.RemoveAll(h.dir)
+	h.dir, h.listener = "", nil
+	return err
+}
+
+func (h *hookServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *hookServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	req := hookRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		h.log.Error("hooks: invalid request", "error", err)
+		return
+	}
+
+	out := &hookOutput{encoder: json.NewEncoder(conn)}
+	log := withFields(h.log, "hook", req.Hook, "path", req.Dir)
+
+	call, err := newHookCall(req, out)
+	if err == nil {
+		call.GitPath = h.gitPath
+		if callback := h.callbacks.forHook(req.Hook); callback != nil {
+			log.Debug("hooks: running callback")
+			err = callback(call)
+		}
+	}
+
+	resp := hookResponse{Done: true}
+	if err != nil {
+		log.Warn("hooks: callback failed", "error", err)
+		resp.Error = err.Error()
+	}
+	out.send(resp)
+}
+
+// newHookCall builds callback arguments from the hook request
+func newHookCall(req hookRequest, out io.Writer) (*HookCall, error) {
+	call := &HookCall{
+		Hook:     req.Hook,
+		RepoName: filepath.Base(req.Dir),
+		RepoPath: req.Dir,
+		Env:      req.Env,
+		Output:   out,
+	}
+
+	// Git commands of the callback need to see quarantined objects
+	gitEnv := []string{}
+	vars := map[string]string{}
+	for _, item := range req.Env {
+		if strings.HasPrefix(item, "GIT_") {
+			gitEnv = append(gitEnv, item)
+		}
+		if chunks := strings.SplitN(item, "=", 2); len(chunks) == 2 {
+			vars[chunks[0]] = chunks[1]
+		}
+	}
+	if repo := vars["GITKIT_REPO"]; repo != "" {
+		call.RepoName = repo
+	}
+
+	input := req.Stdin
+	if req.Hook == "update" {
+		if len(req.Args) != 3 {
+			return nil, fmt.Errorf("invalid update hook arguments")
+		}
+		input = req.Args[1] + " " + req.Args[2] + " " + req.Args[0] + "\n"
+	}
+
+	updates, err := readHookUpdates(strings.NewReader(input), call.RepoName, call.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range updates {
+		info.readEnv(func(name string) string { return vars[name] })
+		info.env = func() ([]string, error) { return gitEnv, nil }
+		call.Updates = append(call.Updates, info)
+	}
+
+	return call, nil
+}
+
+// hookOutput streams callback messages to the hook process
+type hookOutput struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	if err := o.send(hookResponse{Output: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (o *hookOutput) send(resp hookResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.encoder.Encode(resp)
+}
+
+// callbackScript returns a hook script that executes the running binary
+func callbackScript(hook string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	quoted := "'" + strings.Replace(exe, "'", `'\''`, -1) + "'"
+	return fmt.Sprintf("#!/bin/sh\nGITKIT_HOOK=%s exec %s \"$@\"\n", hook, quoted), nil
+}
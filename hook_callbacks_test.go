@@ -0,0 +1,175 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain lets the test binary serve as a hook for HookCallbacks
+func TestMain(m *testing.M) {
+	HookMain()
+	os.Exit(m.Run())
+}
+
+func Test_newHookCall(t *testing.T) {
+	req := hookRequest{
+		Hook:  "pre-receive",
+		Dir:   "/data/org/repo.git",
+		Env:   []string{"GITKIT_REPO=org/repo.git", "GITKIT_USER=john", "GIT_QUARANTINE_PATH=/tmp/q", "HOME=/root"},
+		Stdin: ZeroSHA + " " + testNewRev + " refs/heads/master\n" + ZeroSHA + " " + testNewRev + " refs/tags/v1\n",
+	}
+
+	call, err := newHookCall(req, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "org/repo.git", call.RepoName)
+	require.Len(t, call.Updates, 2)
+	assert.Equal(t, BranchCreateAction, call.Updates[0].Action)
+	assert.Equal(t, TagCreateAction, call.Updates[1].Action)
+	env, err := call.Updates[0].GitEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GIT_QUARANTINE_PATH=/tmp/q"}, env)
+	assert.Equal(t, "org/repo.git", call.Updates[1].RepoName)
+	assert.Equal(t, "john", call.Updates[1].User)
+
+	req = hookRequest{Hook: "update", Dir: "/data/repo.git", Args: []string{"refs/heads/dev", testOldRev, testNewRev}}
+	call, err = newHookCall(req, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "repo.git", call.RepoName)
+	require.Len(t, call.Updates, 1)
+	assert.Equal(t, "refs/heads/dev", call.Updates[0].Ref)
+	assert.Equal(t, testOldRev, call.Updates[0].OldRev)
+
+	_, err = newHookCall(hookRequest{Hook: "update"}, nil)
+	assert.Error(t, err)
+}
+
+func Test_runHookWithoutServer(t *testing.T) {
+	os.Unsetenv("GITKIT_HOOK_SOCKET")
+
+	stderr := bytes.NewBuffer(nil)
+	assert.Equal(t, 1, runHook("pre-receive", nil, strings.NewReader(""), stderr))
+	assert.Equal(t, "gitkit: hook server is not available\n", stderr.String())
+}
+
+func TestHookCallbacks(t *testing.T) {
+	mu := sync.Mutex{}
+	calls := []*HookCall{}
+	record := func(call *HookCall) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+
+	callbacks := &HookCallbacks{
+		PreReceive: func(call *HookCall) error {
+			record(call)
+			for _, update := range call.Updates {
+				// Pushed objects are visible to git commands in the callback
+				if force, err := IsForcePush(update); err != nil || force {
+					return fmt.Errorf("force push to %s is not allowed", update.Ref)
+				}
+			}
+			return nil
+		},
+		Update: func(call *HookCall) error {
+			record(call)
+			fmt.Fprintf(call.Output, "updating %s\n", call.Updates[0].RefName)
+			return nil
+		},
+		PostReceive: func(call *HookCall) error {
+			record(call)
+			fmt.Fprintln(call.Output, "thanks for the push")
+			return nil
+		},
+	}
+
+	server, ts := newTestServer(t, Config{AutoCreate: true, AutoHooks: true, HookCallbacks: callbacks})
+	t.Cleanup(func() { server.hooks.close() })
+	url := ts.URL + "/org/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "tag", "v1")
+	_, stderr, err := runGit(t, work, nil, "push", url, "master", "v1")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "remote: updating master")
+	assert.Contains(t, stderr, "remote: thanks for the push")
+
+	require.Len(t, calls, 4)
+	assert.Equal(t, "pre-receive", calls[0].Hook)
+	assert.Equal(t, "org/test.git", calls[0].RepoName)
+	assert.Len(t, calls[0].Updates, 2)
+	assert.Equal(t, "update", calls[1].Hook)
+	assert.Equal(t, "update", calls[2].Hook)
+	assert.Equal(t, "post-receive", calls[3].Hook)
+	assert.Len(t, calls[3].Updates, 2)
+
+	mustGit(t, work, "commit", "--amend", "--allow-empty", "-m", "Amended commit")
+	_, stderr, err = runGit(t, work, nil, "push", "--force", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "remote: force push to refs/heads/master is not allowed")
+	assert.Contains(t, stderr, "pre-receive hook declined")
+}
+
+func TestHookCallbacksSSH(t *testing.T) {
+	var update *HookInfo
+	callbacks := &HookCallbacks{
+		PreReceive: func(call *HookCall) error {
+			update = call.Updates[0]
+			return fmt.Errorf("pushes to %s are disabled", call.RepoName)
+		},
+	}
+
+	_, port := newTestSSH(t, Config{AutoCreate: true, AutoHooks: true, HookCallbacks: callbacks})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, []string{sshCommand(port)}, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "remote: pushes to test.git are disabled")
+
+	require.NotNil(t, update)
+	assert.Equal(t, "127.0.0.1", update.RemoteAddr)
+	assert.NotEmpty(t, update.RequestID)
+}
+
+func TestHookCallbacksSSHRestart(t *testing.T) {
+	mu := sync.Mutex{}
+	pushes := 0
+	callbacks := &HookCallbacks{
+		PostReceive: func(call *HookCall) error {
+			mu.Lock()
+			defer mu.Unlock()
+			pushes++
+			return nil
+		},
+	}
+
+	server, port := newTestSSH(t, Config{AutoCreate: true, AutoHooks: true, HookCallbacks: callbacks})
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, []string{sshCommand(port)}, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master")
+	require.NoError(t, err, stderr)
+
+	// Hook server is available again after the server is restarted
+	require.NoError(t, server.Stop())
+	require.NoError(t, server.Listen("127.0.0.1:0"))
+	go server.Serve()
+	_, port, err = net.SplitHostPort(server.Address())
+	require.NoError(t, err)
+
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit")
+	_, stderr, err = runGit(t, work, []string{sshCommand(port)}, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master")
+	require.NoError(t, err, stderr)
+	assert.NotContains(t, stderr, "hook server")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, pushes)
+}
@@ -13,8 +13,12 @@ const (
 	BranchPushAction   = "branch.push"
 	BranchCreateAction = "branch.create"
 	BranchDeleteAction = "branch.delete"
+	TagPushAction      = "tag.push"
 	TagCreateAction    = "tag.create"
 	TagDeleteAction    = "tag.delete"
+	RefPushAction      = "ref.push"
+	RefCreateAction    = "ref.create"
+	RefDeleteAction    = "ref.delete"
 )
 
 // HookInfo holds git hook context
@@ -25,45 +29,122 @@ type HookInfo struct {
 	OldRev   string
 	NewRev   string
 	Ref      string
-	RefType  string
-	RefName  string
+	RefType  string // Ref namespace: heads, tags, notes or any other
+	RefName  string // Ref name within the namespace, for example feature/x
+
+	// Pusher details from the environment set by gitkit servers
+	User       string // Authenticated HTTP user or SSH key owner
+	KeyID      string // Authenticated SSH key id
+	RemoteAddr string // Client address
+	RequestID  string // Request id, from X-Request-Id header for HTTP
+
+	env func() ([]string, error) // Extra environment for git commands, set for quarantined pushes
 }
 
-// ReadHookInput reads the hook context
+// ReadHookInput reads the hook context of the first updated ref. Use
+// ReadHookInputs in pre-receive and post-receive hooks to get all of them.
 func ReadHookInput(input io.Reader) (*HookInfo, error) {
-	reader := bufio.NewReader(input)
-
-	line, _, err := reader.ReadLine()
+	hooks, err := ReadHookInputs(input)
 	if err != nil {
 		return nil, err
 	}
 
-	chunks := strings.Split(string(line), " ")
-	if len(chunks) != 3 {
-		return nil, fmt.Errorf("Invalid hook input")
+	if len(hooks) == 0 {
+		return nil, io.EOF
 	}
-	refchunks := strings.Split(chunks[2], "/")
+	return hooks[0], nil
+}
 
+// ReadHookInputs reads the hook context of every updated ref, one per input line
+func ReadHookInputs(input io.Reader) ([]*HookInfo, error) {
 	dir, _ := os.Getwd()
+
+	hooks, err := readHookUpdates(input, filepath.Base(dir), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hook := range hooks {
+		hook.readEnv(os.Getenv)
+	}
+	return hooks, nil
+}
+
+// readHookUpdates parses "<old> <new> <ref>" lines of hook input
+func readHookUpdates(input io.Reader, repoName, repoPath string) ([]*HookInfo, error) {
+	hooks := []*HookInfo{}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		chunks := strings.Split(line, " ")
+		if len(chunks) != 3 {
+			return nil, fmt.Errorf("Invalid hook input")
+		}
+
+		hooks = append(hooks, newHookInfo(repoName, repoPath, chunks[0], chunks[1], chunks[2]))
+	}
+
+	return hooks, scanner.Err()
+}
+
+// GitEnv returns extra environment for git commands that look at objects of
+// the push, which are quarantined until the push is accepted. In ref policies
+// the first call receives pushed objects, so policies that only check names
+// or pusher details do not pay for it.
+func (h *HookInfo) GitEnv() ([]string, error) {
+	if h.env == nil {
+		return nil, nil
+	}
+	return h.env()
+}
+
+// readEnv fills pusher details from GITKIT_* variables
+func (h *HookInfo) readEnv(getenv func(string) string) {
+	if repo := getenv("GITKIT_REPO"); repo != "" {
+		h.RepoName = repo
+	}
+	h.User = getenv("GITKIT_USER")
+	h.KeyID = getenv("GITKIT_KEY")
+	h.RemoteAddr = getenv("GITKIT_REMOTE_ADDR")
+	h.RequestID = getenv("GITKIT_REQUEST_ID")
+}
+
+// newHookInfo returns hook context for a single ref update
+func newHookInfo(repoName, repoPath, oldRev, newRev, ref string) *HookInfo {
 	info := HookInfo{
-		RepoName: filepath.Base(dir),
-		RepoPath: dir,
-		OldRev:   chunks[0],
-		NewRev:   chunks[1],
-		Ref:      chunks[2],
-		RefType:  refchunks[1],
-		RefName:  refchunks[2],
+		RepoName: repoName,
+		RepoPath: repoPath,
+		OldRev:   oldRev,
+		NewRev:   newRev,
+		Ref:      ref,
+	}
+
+	// Names could have slashes, as in refs/heads/feature/x
+	refchunks := strings.SplitN(ref, "/", 3)
+	if len(refchunks) == 3 && refchunks[0] == "refs" {
+		info.RefType = refchunks[1]
+		info.RefName = refchunks[2]
+	} else {
+		info.RefName = ref
 	}
 	info.Action = parseHookAction(info)
 
-	return &info, nil
+	return &info
 }
 
 func parseHookAction(h HookInfo) string {
 	action := "push"
-	context := "branch"
+	context := "ref"
 
-	if h.RefType == "tags" {
+	switch h.RefType {
+	case "heads":
+		context = "branch"
+	case "tags":
 		context = "tag"
 	}
 
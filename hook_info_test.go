@@ -1,10 +1,13 @@
 package gitkit
 
 import (
+	"io"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReadHookInput(t *testing.T) {
@@ -19,6 +22,63 @@ func TestReadHookInput(t *testing.T) {
 	assert.Equal(t, "master", info.RefName)
 }
 
+func TestReadHookInputs(t *testing.T) {
+	input := strings.Join([]string{
+		ZeroSHA + " " + testNewRev + " refs/heads/feature/x",
+		ZeroSHA + " " + testNewRev + " refs/tags/v1.0",
+		testOldRev + " " + testNewRev + " refs/notes/commits",
+		testOldRev + " " + ZeroSHA + " refs/pull/1/head",
+		"",
+	}, "\n")
+
+	hooks, err := ReadHookInputs(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, hooks, 4)
+
+	expected := [][]string{
+		{"refs/heads/feature/x", "heads", "feature/x", BranchCreateAction},
+		{"refs/tags/v1.0", "tags", "v1.0", TagCreateAction},
+		{"refs/notes/commits", "notes", "commits", RefPushAction},
+		{"refs/pull/1/head", "pull", "1/head", RefDeleteAction},
+	}
+	for i, hook := range hooks {
+		assert.Equal(t, expected[i], []string{hook.Ref, hook.RefType, hook.RefName, hook.Action})
+	}
+
+	hook, err := ReadHookInput(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, "refs/heads/feature/x", hook.Ref)
+
+	_, err = ReadHookInputs(strings.NewReader(ZeroSHA + " refs/heads/master\n"))
+	assert.Error(t, err)
+
+	_, err = ReadHookInput(strings.NewReader(""))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadHookInputEnv(t *testing.T) {
+	env := map[string]string{
+		"GITKIT_REPO":        "org/repo.git",
+		"GITKIT_USER":        "john",
+		"GITKIT_REMOTE_ADDR": "10.0.0.1",
+		"GITKIT_REQUEST_ID":  "abc",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	input := "e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/heads/master\n"
+	info, err := ReadHookInput(strings.NewReader(input))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "org/repo.git", info.RepoName)
+	assert.Equal(t, "john", info.User)
+	assert.Equal(t, "", info.KeyID)
+	assert.Equal(t, "10.0.0.1", info.RemoteAddr)
+	assert.Equal(t, "abc", info.RequestID)
+}
+
 func TestHookAction(t *testing.T) {
 	examples := map[string]HookInfo{
 		"branch.create": {
@@ -46,6 +106,21 @@ func TestHookAction(t *testing.T) {
 			NewRev:  "0000000000000000000000000000000000000000",
 			RefType: "tags",
 		},
+		"tag.push": {
+			OldRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			NewRev:  "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2",
+			RefType: "tags",
+		},
+		"ref.create": {
+			OldRev:  "0000000000000000000000000000000000000000",
+			NewRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			RefType: "notes",
+		},
+		"ref.push": {
+			OldRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			NewRev:  "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2",
+			RefType: "pull",
+		},
 	}
 
 	for expected, hook := range examples {
@@ -2,14 +2,22 @@ package gitkit
 
 import (
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/sosedoff/gitkit/pktline"
 )
 
 type service struct {
@@ -17,52 +25,125 @@ type service struct {
 	suffix  string
 	handler func(string, http.ResponseWriter, *Request)
 	rpc     string
+	pattern *regexp.Regexp               // Matches the requested file, used instead of suffix
+	access  func(r *http.Request) string // Git service to authorize, derived from rpc if not set
 }
 
 type Server struct {
-	config   Config
-	services []service
-	AuthFunc func(Credential, *Request) (bool, error)
+	config          Config
+	services        []service
+	limiter         *limiter
+	hooks           *hookServer
+	tracker         *tracker
+	AuthFunc        func(Credential, *Request) (bool, error)
+	Authorizer      Authorizer
+	Observer        Observer
+	ForceUnlockFunc func(identity Identity, repo string) (bool, error) // Allows removing LFS locks of other users, denied if not set
 }
 
+// Operation describes the kind of repository access a request needs
+type Operation string
+
+const (
+	ReadOperation  Operation = "read"
+	WriteOperation Operation = "write"
+)
+
 type Request struct {
 	*http.Request
-	RepoName string
-	RepoPath string
+	RepoName  string
+	RepoPath  string
+	Operation Operation
+	Identity  Identity
+	RequestID string // From X-Request-Id header, or generated
+
+	file    string   // Requested repository file, only set for dumb protocol
+	log     Logger   // Logger with request fields
+	notices []string // Messages for git client from auth callbacks
 }
 
 func New(cfg Config) *Server {
-	s := Server{config: cfg}
+	s := Server{
+		config:  cfg,
+		limiter: newLimiter(cfg.Limits),
+		tracker: newTracker(),
+	}
 	s.services = []service{
-		service{"GET", "/info/refs", s.getInfoRefs, ""},
-		service{"POST", "/git-upload-pack", s.postRPC, "git-upload-pack"},
-		service{"POST", "/git-receive-pack", s.postRPC, "git-receive-pack"},
+		{method: "GET", suffix: "/info/refs", handler: s.getInfoRefs},
+		{method: "POST", suffix: "/git-upload-pack", handler: s.postRPC, rpc: "git-upload-pack"},
+		{method: "POST", suffix: "/git-receive-pack", handler: s.postRPC, rpc: "git-receive-pack"},
+		{method: "POST", suffix: "/git-upload-archive", handler: s.postRPC, rpc: "git-upload-archive"},
+	}
+
+	if s.config.LFS {
+		s.services = append(s.services,
+			service{method: "POST", suffix: "/info/lfs/objects/batch", handler: s.postLFSBatch, access: lfsBatchAccess},
+			service{method: "POST", suffix: "/info/lfs/objects/verify", handler: s.postLFSVerify, access: staticAccess(ServiceReceivePack)},
+			service{method: "GET", pattern: reLFSObject, handler: s.getLFSObject, access: staticAccess(ServiceUploadPack)},
+			service{method: "PUT", pattern: reLFSObject, handler: s.putLFSObject, access: staticAccess(ServiceReceivePack)},
+			service{method: "GET", suffix: "/info/lfs/locks", handler: s.getLFSLocks, access: staticAccess(ServiceUploadPack)},
+			service{method: "POST", suffix: "/info/lfs/locks", handler: s.postLFSLock, access: staticAccess(ServiceReceivePack)},
+			service{method: "POST", suffix: "/info/lfs/locks/verify", handler: s.postLFSLocksVerify, access: staticAccess(ServiceReceivePack)},
+			service{method: "POST", pattern: reLFSUnlock, handler: s.postLFSUnlock, access: staticAccess(ServiceReceivePack)},
+		)
+	}
+
+	if s.config.DumbHTTP {
+		s.services = append(s.services,
+			service{method: "GET", pattern: reDumbFile, handler: s.getFile},
+			service{method: "HEAD", pattern: reDumbFile, handler: s.getFile},
+		)
 	}
 
 	// Use PATH if full path is not specified
 	if s.config.GitPath == "" {
 		s.config.GitPath = "git"
 	}
+	s.hooks = newHookServer(s.config.HookCallbacks, s.config.GitPath, s.config.logger())
 
 	return &s
 }
 
-// findService returns a matching git subservice and parsed repository name
-func (s *Server) findService(req *http.Request) (*service, string) {
+// findService returns a matching git subservice, parsed repository name and
+// requested file for dumb protocol services.
+func (s *Server) findService(req *http.Request) (*service, string, string) {
 	for _, svc := range s.services {
-		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
+		if svc.method != req.Method {
+			continue
+		}
+
+		if svc.pattern != nil {
+			if loc := svc.pattern.FindStringSubmatchIndex(req.URL.Path); loc != nil {
+				return &svc, req.URL.Path[:loc[0]], req.URL.Path[loc[2]:loc[3]]
+			}
+			continue
+		}
+
+		if strings.HasSuffix(req.URL.Path, svc.suffix) {
 			path := strings.Replace(req.URL.Path, svc.suffix, "", 1)
-			return &svc, path
+			return &svc, path, ""
 		}
 	}
-	return nil, ""
+	return nil, "", ""
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	start := time.Now()
+	logger := withFields(s.config.logger(), "remote_addr", r.RemoteAddr)
+	logger.Info("request", "method", r.Method, "url", r.Host+r.URL.String())
+
+	done, ok := s.tracker.begin()
+	if !ok {
+		logger.Warn("request", "error", ErrServerClosed)
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, ErrServerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
 
 	// Find the git subservice to handle the request
-	svc, repoUrlPath := s.findService(r)
+	svc, repoUrlPath, file := s.findService(r)
 	if svc == nil {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
@@ -71,59 +152,146 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Determine namespace and repo name from request path
 	repoNamespace, repoName := getNamespaceAndRepo(repoUrlPath)
 	if repoName == "" {
-		logError("auth", fmt.Errorf("no repo name provided"))
+		logger.Error("auth", "error", "no repo name provided")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	// Validate the name as requested, before it's cleaned up by path.Join
+	fullName := repoName
+	if repoNamespace != "" {
+		fullName = repoNamespace + "/" + repoName
+	}
+	if err := s.config.RepoNames.Validate(fullName); err != nil {
+		logger.Warn("repo-name", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, repoPath, err := resolveRepo(s.config.resolver(), s.config.RepoNames, fullName)
+	if err != nil {
+		if errors.Is(err, ErrRepoNotFound) {
+			logger.Warn("repo-resolve", "error", err, "repo", fullName)
+			http.NotFound(w, r)
+			return
+		}
+		fail500(w, logger, "repo-resolve", err)
+		return
+	}
+
+	gitService := requestService(svc, r)
+
 	req := &Request{
-		Request:  r,
-		RepoName: path.Join(repoNamespace, repoName),
-		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
+		Request:   r,
+		RepoName:  name,
+		RepoPath:  repoPath,
+		Operation: serviceOperation(gitService),
+		RequestID: requestID(r.Header.Get("X-Request-Id")),
+		file:      file,
 	}
+	req.log = withFields(logger, "repo", name, "service", gitService, "request_id", req.RequestID)
+	w.Header().Set("X-Request-Id", req.RequestID)
+	defer func() {
+		req.log.Debug("request finished", "duration", time.Since(start))
+	}()
 
 	if s.config.Auth {
 		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
+			req.log.Error("auth", "error", "no auth backend provided")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
-			w.WriteHeader(http.StatusUnauthorized)
+		cred := Credential{}
+
+		if r.Header.Get("Authorization") != "" {
+			var err error
+			cred, err = getCredential(r)
+			if err != nil {
+				req.log.Error("auth", "error", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else if !s.config.AllowAnonymous {
+			requestCredentials(w)
 			return
 		}
 
-		cred, err := getCredential(r)
-		if err != nil {
-			logError("auth", err)
-			w.WriteHeader(http.StatusUnauthorized)
+		// Auth func could replace the identity, for example to map tokens to users
+		req.Identity = Identity{Username: cred.Username}
+		allow, err := s.AuthFunc(cred, req)
+		message, hasMessage := clientMessage(err)
+
+		if allow && isNotice(err) {
+			req.notices = append(req.notices, message)
+		} else if !allow || err != nil {
+			if err != nil && !hasMessage {
+				req.log.Error("auth", "error", err, "user", cred.Username)
+			}
+
+			// Let git client prompt for credentials when anonymous access is denied
+			if cred.Username == "" {
+				requestCredentials(w)
+				return
+			}
+
+			req.log.Warn("auth", "error", "user rejected", "user", cred.Username)
+			deny(w, r, http.StatusUnauthorized, message)
 			return
 		}
 
-		allow, err := s.AuthFunc(cred, req)
-		if !allow || err != nil {
-			if err != nil {
-				logError("auth", err)
+		req.log = withFields(req.log, "user", req.Identity.Username)
+	}
+
+	if s.Authorizer != nil {
+		allow, err := s.Authorizer.Authorize(req.Identity, req.RepoName, gitService)
+		message, hasMessage := clientMessage(err)
+
+		if allow && isNotice(err) {
+			req.notices = append(req.notices, message)
+		} else if !allow || err != nil {
+			if err != nil && !hasMessage {
+				req.log.Error("auth", "error", err)
 			}
 
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
-			w.WriteHeader(http.StatusUnauthorized)
+			if s.config.Auth && req.Identity.IsAnonymous() {
+				requestCredentials(w)
+				return
+			}
+
+			req.log.Warn("auth", "error", "access denied")
+			deny(w, r, http.StatusForbidden, message)
 			return
 		}
 	}
 
+	// Git clients show text/plain error responses as remote messages
+	if message, blocked := s.config.Modes.pushBlocked(req.RepoName); blocked && req.Operation == WriteOperation {
+		req.log.Warn("modes", "error", message)
+		http.Error(w, message, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Git clients follow redirects of the initial request and use the new
+	// location for the rest of the session. Other requests are served in place.
+	if name != fullName && svc.suffix == "/info/refs" {
+		location := requestPathPrefix(r) + "/" + name + svc.suffix
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return
+	}
+
 	if !repoExists(req.RepoPath) && s.config.AutoCreate == true {
-		err := initRepo(req.RepoName, &s.config)
+		err := initRepo(req.RepoPath, &s.config)
 		if err != nil {
-			logError("repo-init", err)
+			req.log.Error("repo-init", "error", err)
 		}
 	}
 
 	if !repoExists(req.RepoPath) {
-		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
+		req.log.Warn("repo-init", "error", "repository does not exist", "path", req.RepoPath)
 		http.NotFound(w, r)
 		return
 	}
@@ -131,77 +299,254 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	svc.handler(svc.rpc, w, req)
 }
 
+// acquireSlot waits for a free slot to run git process. Request is rejected
+// with 429 status if limits are exceeded.
+func (s *Server) acquireSlot(w http.ResponseWriter, r *Request) (func(), bool) {
+	release, err := s.limiter.acquire(r.Context(), r.RepoName, r.Identity)
+	if err != nil {
+		r.log.Warn("limits", "error", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, ErrTooManyRequests.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	return release, true
+}
+
+// requestPathPrefix returns the part of request path stripped by http.StripPrefix
+func requestPathPrefix(r *http.Request) string {
+	uri, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || !strings.HasSuffix(uri.Path, r.URL.Path) {
+		return ""
+	}
+	return strings.TrimSuffix(uri.Path[:len(uri.Path)-len(r.URL.Path)], "/")
+}
+
+// requestService returns the git service the request is going to run
+func requestService(svc *service, r *http.Request) string {
+	if svc.access != nil {
+		return svc.access(r)
+	}
+
+	rpc := svc.rpc
+	if rpc == "" {
+		rpc = r.URL.Query().Get("service")
+	}
+
+	return rpcService(rpc)
+}
+
+// staticAccess returns access func for services that always run the same git service
+func staticAccess(service string) func(*http.Request) string {
+	return func(*http.Request) string {
+		return service
+	}
+}
+
+// deny rejects the request with a message for the git client. Ref advertisement
+// carries the message in ERR packet, which git shows as a remote error.
+func deny(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if message == "" {
+		if status == http.StatusUnauthorized {
+			w.WriteHeader(status)
+		} else {
+			http.Error(w, http.StatusText(status), status)
+		}
+		return
+	}
+
+	rpc := r.URL.Query().Get("service")
+	if strings.HasSuffix(r.URL.Path, "/info/refs") && (rpc == "git-upload-pack" || rpc == "git-receive-pack") {
+		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		pktline.NewEncoder(w).Error(message)
+		return
+	}
+
+	http.Error(w, message, status)
+}
+
+// requestCredentials asks the client to provide basic auth credentials
+func requestCredentials(w http.ResponseWriter) {
+	w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
 func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 	context := "get-info-refs"
 	rpc := r.URL.Query().Get("service")
 
-	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
+	if rpc == "" && s.config.DumbHTTP {
+		s.getInfoRefsDumb(w, r)
+		return
+	}
+
+	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack" || rpc == "git-upload-archive") {
 		http.Error(w, "Not Found", 404)
 		return
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
-	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+	// upload-archive has no advertisement of its own, clients discover protocol
+	// version with upload-pack before posting archive arguments
+	command := rpc
+	if rpcService(rpc) == ServiceUploadArchive {
+		command = "git-upload-pack"
+	}
+
+	release, ok := s.acquireSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	obs := s.observe(r, rpc, true, w)
+	var err error
+	defer func() { obs.finish(err) }()
+
+	protocol := parseGitProtocol(r.Header.Get("Git-Protocol"))
+
+	ctx, cancel := s.commandContext(r, rpc)
+	defer cancel()
+
+	args := s.config.serviceArgs(command, r.RepoName, "--stateless-rpc", "--advertise-refs", r.RepoPath)
+	cmd, pipe := gitCommand(s.config.GitPath, append(gitEnv(protocol), s.sessionEnv(r)...), args...)
+	if err = cmd.Start(); err != nil {
+		fail500(w, r.log, context, err)
 		return
 	}
 	defer cleanUpProcessGroup(cmd)
+	defer killOnDone(ctx, cmd)()
+	defer s.tracker.addProcess(cmd)()
 
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
 	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		logError(context, err)
-		return
-	}
+	// Protocol v2 capability advertisement is not prefixed with the service line
+	if !isProtocolV2(protocol) {
+		enc := pktline.NewEncoder(obs.out)
+		if err = enc.Encodef("# service=%s\n", rpc); err != nil {
+			r.log.Error(context, "error", err)
+			return
+		}
 
-	if err := packFlush(w); err != nil {
-		logError(context, err)
-		return
+		if err = enc.Flush(); err != nil {
+			r.log.Error(context, "error", err)
+			return
+		}
 	}
 
-	if _, err := io.Copy(w, pipe); err != nil {
-		logError(context, err)
+	if _, err = io.Copy(obs.out, pipe); err != nil {
+		r.log.Error(context, "error", err)
 		return
 	}
 
-	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+	err = cmd.Wait()
+	obs.exited(err)
+	if err != nil {
+		r.log.Error(context, "error", err)
 		return
 	}
 }
 
 func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 	context := "post-rpc"
-	body := r.Body
 
+	release, ok := s.acquireSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	obs := s.observe(r, rpc, false, newNoticeWriter(newWriteFlusher(w), r.notices))
+	var err error
+	defer func() { obs.finish(err) }()
+
+	var body io.Reader = obs.in
 	if r.Header.Get("Content-Encoding") == "gzip" {
-		var err error
-		body, err = gzip.NewReader(r.Body)
+		body, err = gzip.NewReader(body)
 		if err != nil {
-			fail500(w, context, err)
+			fail500(w, r.log, context, err)
+			return
+		}
+	}
+
+	if rpc == "git-receive-pack" && len(s.config.RefPolicies) > 0 {
+		var replay io.ReadCloser
+		var report []byte
+
+		replay, report, err = enforceRefPolicies(&s.config, s.sessionEnv(r), r.RepoName, r.RepoPath, body)
+		if err != nil {
+			fail500(w, r.log, context, err)
+			return
+		}
+
+		if replay == nil {
+			r.log.Warn(context, "error", "push rejected by ref policy")
+			w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
+			w.Header().Add("Cache-Control", "no-cache")
+			w.WriteHeader(200)
+			obs.out.Write(report)
+			return
+		}
+
+		defer replay.Close()
+		body = replay
+	}
+
+	protocol := parseGitProtocol(r.Header.Get("Git-Protocol"))
+
+	ctx, cancel := s.commandContext(r, rpc)
+	defer cancel()
+
+	env := append(gitEnv(protocol), s.sessionEnv(r)...)
+
+	if rpc == "git-receive-pack" {
+		var hookEnv []string
+		if hookEnv, err = s.hooks.env(); err != nil {
+			fail500(w, r.log, context, err)
 			return
 		}
+		env = append(env, hookEnv...)
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	// upload-archive has no stateless mode, it serves a single request anyway
+	args := s.config.serviceArgs(rpc, r.RepoName, "--stateless-rpc", r.RepoPath)
+	if rpcService(rpc) == ServiceUploadArchive {
+		args = s.config.serviceArgs(rpc, r.RepoName, r.RepoPath)
+	}
+
+	if rpcService(rpc) == ServiceUploadPack && s.config.denyShallow(r.RepoName) {
+		body = newShallowGuard(body)
+	}
+
+	cmd, pipe := gitCommand(s.config.GitPath, env, args...)
 	defer pipe.Close()
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		fail500(w, context, err)
+		fail500(w, r.log, context, err)
 		return
 	}
 	defer stdin.Close()
 
-	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+	if err = cmd.Start(); err != nil {
+		fail500(w, r.log, context, err)
 		return
 	}
 	defer cleanUpProcessGroup(cmd)
+	defer killOnDone(ctx, cmd)()
+	defer s.tracker.addProcess(cmd)()
+
+	if _, err = io.Copy(stdin, body); err != nil {
+		if err == ErrShallowDenied {
+			r.log.Warn(context, "error", err)
+			w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
+			w.WriteHeader(200)
+			pktline.NewEncoder(obs.out).Error(err.Error())
+			return
+		}
 
-	if _, err := io.Copy(stdin, body); err != nil {
-		fail500(w, context, err)
+		fail500(w, r.log, context, err)
 		return
 	}
 	stdin.Close()
@@ -210,43 +555,118 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
-		logError(context, err)
+	if _, err = io.Copy(obs.out, pipe); err != nil {
+		r.log.Error(context, "error", err)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+
+	err = cmd.Wait()
+	obs.exited(err)
+	if err != nil {
+		r.log.Error(context, "error", err)
 		return
 	}
+
+	if rpc == "git-receive-pack" && s.config.DumbHTTP {
+		if err := updateServerInfo(&s.config, r.RepoPath); err != nil {
+			r.log.Error(context, "error", err)
+		}
+	}
+}
+
+// observe starts tracking of a git service call for the observer
+func (s *Server) observe(r *Request, rpc string, advertise bool, w io.Writer) *observation {
+	event := Event{
+		Transport:  TransportHTTP,
+		Repo:       r.RepoName,
+		Service:    subCommand(rpc),
+		Identity:   r.Identity,
+		RemoteAddr: r.RemoteAddr,
+		Advertise:  advertise,
+	}
+	return observe(s.Observer, event, r.Body, w)
+}
+
+// sessionEnv returns environment describing the request for git processes
+func (s *Server) sessionEnv(r *Request) []string {
+	remoteAddr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	return sessionEnv(r.Identity, r.RepoName, remoteAddr, r.RequestID)
+}
+
+// commandContext returns a context for git process that is cancelled when the
+// client goes away or the service timeout is reached.
+func (s *Server) commandContext(r *Request, rpc string) (context.Context, context.CancelFunc) {
+	if timeout := s.config.Timeouts.forService(rpc); timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
 }
 
 func (s *Server) Setup() error {
 	return s.config.Setup()
 }
 
-func initRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+// Shutdown stops serving new requests with 503 status and waits for active
+// requests to finish. Git processes still running when the context is done are
+// killed. Listeners are not closed, use Shutdown of http.Server for that.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.tracker.shutdown(ctx)
+	s.hooks.close()
+	return err
+}
 
+func initRepo(fullPath string, config *Config) error {
 	if err := exec.Command(config.GitPath, "init", "--bare", fullPath).Run(); err != nil {
 		return err
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
-		return config.Hooks.setupInDir(fullPath)
+	if config.DumbHTTP {
+		if err := updateServerInfo(config, fullPath); err != nil {
+			return err
+		}
+	}
+
+	if config.AutoHooks && (config.Hooks != nil || config.HookCallbacks != nil) {
+		scripts, err := config.hookScripts()
+		if err != nil {
+			return err
+		}
+		return scripts.setupInDir(fullPath)
 	}
 
 	return nil
 }
 
+// updateServerInfo refreshes auxiliary files used by the dumb protocol
+func updateServerInfo(config *Config, repoPath string) error {
+	out, err := exec.Command(config.GitPath, "-C", repoPath, "update-server-info").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("update-server-info failed: %s", out)
+	}
+	return nil
+}
+
 func repoExists(p string) bool {
 	_, err := os.Stat(path.Join(p, "objects"))
 	return err == nil
 }
 
-func gitCommand(name string, args ...string) (*exec.Cmd, io.ReadCloser) {
+// gitEnv returns extra environment variables for git processes
+func gitEnv(protocol string) []string {
+	env := []string{}
+	if protocol != "" {
+		env = append(env, "GIT_PROTOCOL="+protocol)
+	}
+	return env
+}
+
+func gitCommand(name string, env []string, args ...string) (*exec.Cmd, io.ReadCloser) {
 	cmd := exec.Command(name, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Env = os.Environ()
+	cmd.Env = append(os.Environ(), env...)
 
 	r, _ := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
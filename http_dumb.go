@@ -0,0 +1,79 @@
+package gitkit
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// reDumbFile matches repository files served over dumb HTTP protocol
+var reDumbFile = regexp.MustCompile(`/(HEAD|info/refs|objects/info/(?:packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(?:pack|idx))$`)
+
+// dumbContentType returns content type for a dumb protocol file
+func dumbContentType(file string) string {
+	switch {
+	case file == "objects/info/packs":
+		return "text/plain; charset=utf-8"
+	case strings.HasSuffix(file, ".pack"):
+		return "application/x-git-packed-objects"
+	case strings.HasSuffix(file, ".idx"):
+		return "application/x-git-packed-objects-toc"
+	case strings.HasPrefix(file, "objects/") && !strings.HasPrefix(file, "objects/info/"):
+		return "application/x-git-loose-object"
+	default:
+		return "text/plain"
+	}
+}
+
+func setNoCacheHeaders(h http.Header) {
+	h.Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	h.Set("Pragma", "no-cache")
+	h.Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+func setCacheForeverHeaders(h http.Header) {
+	h.Set("Expires", time.Now().Add(365*24*time.Hour).UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "public, max-age=31536000")
+}
+
+func (s *Server) getInfoRefsDumb(w http.ResponseWriter, r *Request) {
+	// Repositories created before dumb protocol was enabled might not have refs file
+	if !fileExists(filepath.Join(r.RepoPath, "info", "refs")) {
+		if err := updateServerInfo(&s.config, r.RepoPath); err != nil {
+			fail500(w, r.log, "get-info-refs", err)
+			return
+		}
+	}
+
+	r.file = "info/refs"
+	s.getFile("", w, r)
+}
+
+func (s *Server) getFile(_ string, w http.ResponseWriter, r *Request) {
+	f, err := os.Open(filepath.Join(r.RepoPath, filepath.FromSlash(r.file)))
+	if err != nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	// Objects and packs are immutable, everything else changes with pushes
+	contentType := dumbContentType(r.file)
+	if strings.HasPrefix(contentType, "text/plain") {
+		setNoCacheHeaders(w.Header())
+	} else {
+		setCacheForeverHeaders(w.Header())
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	http.ServeContent(w, r.Request, "", stat.ModTime(), f)
+}
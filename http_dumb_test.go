@@ -0,0 +1,80 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_dumbContentType(t *testing.T) {
+	cases := map[string]string{
+		"HEAD":               "text/plain",
+		"info/refs":          "text/plain",
+		"objects/info/packs": "text/plain; charset=utf-8",
+		"objects/e6/9de29bb2d1d6434b8b29ae775ad8c2e48c5391":               "application/x-git-loose-object",
+		"objects/pack/pack-e69de29bb2d1d6434b8b29ae775ad8c2e48c5391.pack": "application/x-git-packed-objects",
+		"objects/pack/pack-e69de29bb2d1d6434b8b29ae775ad8c2e48c5391.idx":  "application/x-git-packed-objects-toc",
+		"objects/info/alternates":                                         "text/plain",
+	}
+
+	for example, expected := range cases {
+		assert.Equal(t, expected, dumbContentType(example))
+	}
+}
+
+func TestDumbHTTP(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true, DumbHTTP: true})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+
+	dest := t.TempDir()
+	_, stderr, err := runGit(t, dest, []string{"GIT_SMART_HTTP=0", "GIT_TRACE_CURL=1"}, "clone", url, "clone")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "GET /test.git/info/refs HTTP")
+	assert.NotContains(t, stderr, "service=git-upload-pack")
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+
+	resp, err := http.Head(url + "/HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-cache, max-age=0, must-revalidate", resp.Header.Get("Cache-Control"))
+
+	for _, path := range []string{"/config", "/hooks/pre-receive", "/objects/../config", "/objects/info/../../config"} {
+		resp, err = http.Get(url + path)
+		require.NoError(t, err)
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestDumbHTTPAfterSSHPush(t *testing.T) {
+	dir := t.TempDir()
+	_, port := newTestSSH(t, Config{Dir: dir, AutoCreate: true, DumbHTTP: true})
+	_, ts := newTestServer(t, Config{Dir: dir, DumbHTTP: true})
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, []string{sshCommand(port)}, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master")
+	require.NoError(t, err, stderr)
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, []string{"GIT_SMART_HTTP=0"}, "clone", ts.URL+"/test.git", "clone")
+	require.NoError(t, err, stderr)
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+}
+
+func TestDumbHTTPDisabled(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true})
+
+	resp, err := http.Get(ts.URL + "/test.git/HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/test.git/info/refs")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
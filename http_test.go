@@ -0,0 +1,335 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger discards log output of test servers
+var testLogger = StdLogger{Logger: log.New(ioutil.Discard, "", 0)}
+
+// gitEnvironment isolates test git commands from the user and system configs
+func gitEnvironment(home string) []string {
+	return append(os.Environ(),
+		"HOME="+home,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=gitkit",
+		"GIT_AUTHOR_EMAIL=gitkit@localhost",
+		"GIT_COMMITTER_NAME=gitkit",
+		"GIT_COMMITTER_EMAIL=gitkit@localhost",
+	)
+}
+
+// runGit executes a git command in dir and returns its stdout and stderr
+func runGit(t *testing.T, dir string, env []string, args ...string) (string, string, error) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(gitEnvironment(dir), env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// mustGit executes a git command in dir and fails the test on error
+func mustGit(t *testing.T, dir string, args ...string) string {
+	stdout, stderr, err := runGit(t, dir, nil, args...)
+	require.NoError(t, err, stderr)
+	return stdout
+}
+
+// newWorkTree creates a local repository with a single commit
+func newWorkTree(t *testing.T) string {
+	dir := t.TempDir()
+	mustGit(t, dir, "-c", "init.defaultBranch=master", "init")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+	mustGit(t, dir, "add", "README")
+	mustGit(t, dir, "commit", "-m", "Initial commit")
+	return dir
+}
+
+// gitVersionAtLeast checks version of the installed git
+func gitVersionAtLeast(t *testing.T, major int, minor int) bool {
+	out := mustGit(t, t.TempDir(), "version")
+
+	version := [2]int{}
+	fmt.Sscanf(strings.TrimPrefix(strings.TrimSpace(out), "git version "), "%d.%d", &version[0], &version[1])
+	return version[0] > major || version[0] == major && version[1] >= minor
+}
+
+// newTestServer starts an HTTP git server with repositories in a temp directory.
+// Setup funcs configure the server before it starts serving requests.
+func newTestServer(t *testing.T, cfg Config, setup ...func(*Server)) (*Server, *httptest.Server) {
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = testLogger
+	}
+
+	server := New(cfg)
+	require.NoError(t, server.Setup())
+	for _, fn := range setup {
+		fn(server)
+	}
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return server, ts
+}
+
+func TestProtocolV2(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+
+	dest := t.TempDir()
+	_, stderr, err := runGit(t, dest, []string{"GIT_TRACE_PACKET=1"}, "-c", "protocol.version=2", "clone", url, "clone")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "< version 2")
+	assert.Contains(t, stderr, "> command=ls-refs")
+	assert.Contains(t, stderr, "> command=fetch")
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+
+	_, stderr, err = runGit(t, dest, []string{"GIT_TRACE_PACKET=1"}, "-c", "protocol.version=2", "ls-remote", "-o", "hello", url)
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "> server-option=hello")
+
+	_, stderr, err = runGit(t, dest, []string{"GIT_TRACE_PACKET=1"}, "-c", "protocol.version=0", "ls-remote", url)
+	require.NoError(t, err, stderr)
+	assert.NotContains(t, stderr, "< version 2")
+}
+
+// newSlowGit creates a fake git binary that records its pid and hangs
+func newSlowGit(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "pid")
+	gitPath := filepath.Join(dir, "git")
+
+	script := "#!/bin/sh\necho $$ > " + pidFile + "\nexec sleep 30\n"
+	require.NoError(t, ioutil.WriteFile(gitPath, []byte(script), 0755))
+
+	return gitPath, pidFile
+}
+
+// waitProcessExit waits for a process recorded in pid file to terminate
+func waitProcessExit(t *testing.T, pidFile string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := ioutil.ReadFile(pidFile)
+		if err == nil && len(data) > 0 {
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+				return true
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestClientDisconnectKillsGit(t *testing.T) {
+	gitPath, pidFile := newSlowGit(t)
+	server, ts := newTestServer(t, Config{GitPath: gitPath})
+	require.NoError(t, os.MkdirAll(filepath.Join(server.config.Dir, "test.git", "objects"), 0755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+
+	_, err := http.DefaultClient.Do(req)
+	require.Error(t, err)
+
+	assert.True(t, waitProcessExit(t, pidFile), "git process is still running")
+}
+
+func TestServiceTimeout(t *testing.T) {
+	gitPath, pidFile := newSlowGit(t)
+	server, ts := newTestServer(t, Config{
+		GitPath:  gitPath,
+		Timeouts: Timeouts{UploadPack: 200 * time.Millisecond},
+	})
+	require.NoError(t, os.MkdirAll(filepath.Join(server.config.Dir, "test.git", "objects"), 0755))
+
+	start := time.Now()
+	resp, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.True(t, waitProcessExit(t, pidFile), "git process is still running")
+}
+
+func TestAnonymousReadAccess(t *testing.T) {
+	operations := map[Operation]int{}
+	mu := sync.Mutex{}
+
+	_, ts := newTestServer(t, Config{AutoCreate: true, Auth: true, AllowAnonymous: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			mu.Lock()
+			operations[req.Operation]++
+			mu.Unlock()
+
+			if cred.Username == "" {
+				return req.Operation == ReadOperation, nil
+			}
+			return cred.Username == "hello", nil
+		}
+	})
+
+	work := newWorkTree(t)
+
+	_, stderr, err := runGit(t, work, nil, "push", ts.URL+"/test.git", "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "could not read Username")
+
+	authURL := strings.Replace(ts.URL, "http://", "http://hello:world@", 1) + "/test.git"
+	_, stderr, err = runGit(t, work, nil, "push", authURL, "master")
+	require.NoError(t, err, stderr)
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, nil, "clone", ts.URL+"/test.git", "clone")
+	require.NoError(t, err, stderr)
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+
+	assert.NotZero(t, operations[ReadOperation])
+	assert.NotZero(t, operations[WriteOperation])
+}
+
+func TestSessionEnv(t *testing.T) {
+	var update *HookInfo
+	callbacks := &HookCallbacks{
+		PreReceive: func(call *HookCall) error {
+			update = call.Updates[0]
+			return nil
+		},
+	}
+
+	server, ts := newTestServer(t, Config{AutoCreate: true, AutoHooks: true, Auth: true, HookCallbacks: callbacks}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			// Tokens are mapped to users
+			if cred.Password == "token" {
+				req.Identity.Username = "john"
+				return true, nil
+			}
+			return false, nil
+		}
+	})
+	t.Cleanup(func() { server.hooks.close() })
+
+	work := newWorkTree(t)
+	url := strings.Replace(ts.URL, "http://", "http://x-token:token@", 1) + "/org/test.git"
+	_, stderr, err := runGit(t, work, nil, "-c", "http.extraHeader=X-Request-Id: req-123", "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	require.NotNil(t, update)
+	assert.Equal(t, "org/test.git", update.RepoName)
+	assert.Equal(t, "john", update.User)
+	assert.Equal(t, "127.0.0.1", update.RemoteAddr)
+	assert.Equal(t, "req-123", update.RequestID)
+
+	resp, err := http.Get(ts.URL + "/org/test.git/info/refs?service=git-upload-pack")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Len(t, resp.Header.Get("X-Request-Id"), 36)
+}
+
+func TestAnonymousAccessDisabled(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true, Auth: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			return true, nil
+		}
+	})
+
+	resp, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm=""`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestUploadArchive(t *testing.T) {
+	services := []string{}
+	_, ts := newTestServer(t, Config{AutoCreate: true}, func(s *Server) {
+		s.Authorizer = AuthorizerFunc(func(identity Identity, repo string, service string) (bool, error) {
+			services = append(services, service)
+			return true, nil
+		})
+	})
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", ts.URL+"/test.git", "master")
+
+	body := bytes.NewBuffer(nil)
+	packLine(body, "argument --format=tar\n")
+	packLine(body, "argument master\n")
+	packFlush(body)
+
+	resp, err := http.Post(ts.URL+"/test.git/git-upload-archive", "application/x-git-upload-archive-request", body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-git-upload-archive-result", resp.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(string(data), "0008ACK\n0000"))
+	assert.Contains(t, string(data), "README")
+	assert.Equal(t, ServiceUploadArchive, services[len(services)-1])
+
+	// Protocol discovery for archive clients
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-archive", nil)
+	require.NoError(t, err)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, _ = ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-git-upload-archive-advertisement", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(data), "version 2")
+	assert.Equal(t, ServiceUploadArchive, services[len(services)-1])
+}
+
+func TestUploadArchiveClient(t *testing.T) {
+	// Archives over HTTP are supported by git clients since 2.44
+	if !gitVersionAtLeast(t, 2, 44) {
+		t.Skip("git does not support archive over HTTP")
+	}
+
+	_, ts := newTestServer(t, Config{AutoCreate: true})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+
+	stdout, stderr, err := runGit(t, work, nil, "-c", "protocol.version=2", "archive", "--remote="+url, "--format=tar", "master")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stdout, "README")
+	assert.Contains(t, stdout, "hello")
+}
@@ -0,0 +1,332 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	lfsContentType  = "application/vnd.git-lfs+json"
+	lfsMaxBatchSize = 10 * 1024 * 1024
+
+	// lfsBatchPeekSize limits how much of a batch request is read before authentication
+	lfsBatchPeekSize = 4 * 1024
+)
+
+var (
+	reLFSObject = regexp.MustCompile(`/info/lfs/objects/([0-9a-f]{64})$`)
+	reLFSOid    = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers,omitempty"`
+	Objects   []lfsPointer `json:"objects"`
+	HashAlgo  string       `json:"hash_algo,omitempty"`
+}
+
+type lfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+	HashAlgo string      `json:"hash_algo"`
+}
+
+type lfsObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsError struct {
+	Message string `json:"message"`
+}
+
+// lfsStorage keeps LFS objects of a repository in a content addressed directory
+type lfsStorage struct {
+	dir string
+}
+
+func newLFSStorage(repoPath string) lfsStorage {
+	return lfsStorage{dir: filepath.Join(repoPath, "lfs")}
+}
+
+// path returns location of the object, e.g. lfs/objects/ab/cd/abcd...
+func (s lfsStorage) path(oid string) string {
+	return filepath.Join(s.dir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// size returns size of a stored object
+func (s lfsStorage) size(oid string) (int64, bool) {
+	stat, err := os.Stat(s.path(oid))
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0, false
+	}
+	return stat.Size(), true
+}
+
+// put stores the object if its content matches the oid
+func (s lfsStorage) put(oid string, r io.Reader) error {
+	tmpDir := filepath.Join(s.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(tmpDir, oid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != oid {
+		return errLFSOidMismatch
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path(oid)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(oid))
+}
+
+var errLFSOidMismatch = fmt.Errorf("object content does not match oid")
+
+// lfsBatchAccess returns git service to authorize for a batch request. Only the
+// beginning of the body is read to find the operation and it's put back for the
+// handler. Requests without download operation there need write access.
+func lfsBatchAccess(r *http.Request) string {
+	peek := &bytes.Buffer{}
+	operation := lfsBatchOperation(io.TeeReader(io.LimitReader(r.Body, lfsBatchPeekSize), peek))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(peek, r.Body), r.Body}
+
+	if operation == "download" {
+		return ServiceUploadPack
+	}
+	return ServiceReceivePack
+}
+
+// lfsBatchOperation scans top level keys of batch request for the operation
+func lfsBatchOperation(r io.Reader) string {
+	dec := json.NewDecoder(r)
+	if token, err := dec.Token(); err != nil || token != json.Delim('{') {
+		return ""
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+
+		if key == "operation" {
+			operation := ""
+			if err := dec.Decode(&operation); err != nil {
+				return ""
+			}
+			return operation
+		}
+
+		value := json.RawMessage{}
+		if err := dec.Decode(&value); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+// lfsBaseURL returns URL of LFS API for the repository
+func lfsBaseURL(r *Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	// Request URI keeps path prefix stripped by http.StripPrefix
+	uri := r.RequestURI
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri = uri[:i]
+	}
+	uri = strings.TrimSuffix(uri, "/objects/batch")
+
+	return scheme + "://" + r.Host + uri
+}
+
+func writeLFSJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) postLFSBatch(_ string, w http.ResponseWriter, r *Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, lfsMaxBatchSize+1))
+	if err != nil {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid batch request"})
+		return
+	}
+	if len(body) > lfsMaxBatchSize {
+		writeLFSJSON(w, http.StatusRequestEntityTooLarge, lfsError{"Batch request is too large"})
+		return
+	}
+
+	batch := lfsBatchRequest{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid batch request"})
+		return
+	}
+
+	if batch.Operation != "download" && batch.Operation != "upload" {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid operation"})
+		return
+	}
+
+	if batch.HashAlgo != "" && batch.HashAlgo != "sha256" {
+		writeLFSJSON(w, http.StatusConflict, lfsError{"Unsupported hash algorithm"})
+		return
+	}
+
+	if len(batch.Transfers) > 0 && !stringInSlice("basic", batch.Transfers) {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Unsupported transfer adapter"})
+		return
+	}
+
+	// Pass client credentials to transfer requests
+	header := map[string]string{}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header["Authorization"] = auth
+	}
+
+	storage := newLFSStorage(r.RepoPath)
+	baseURL := lfsBaseURL(r)
+
+	resp := lfsBatchResponse{
+		Transfer: "basic",
+		HashAlgo: "sha256",
+		Objects:  make([]lfsObject, 0, len(batch.Objects)),
+	}
+
+	for _, ptr := range batch.Objects {
+		obj := lfsObject{Oid: ptr.Oid, Size: ptr.Size, Authenticated: true}
+
+		if !reLFSOid.MatchString(ptr.Oid) || ptr.Size < 0 {
+			obj.Error = &lfsObjectError{http.StatusUnprocessableEntity, "Invalid object"}
+			resp.Objects = append(resp.Objects, obj)
+			continue
+		}
+
+		size, exists := storage.size(ptr.Oid)
+		href := baseURL + "/objects/" + ptr.Oid
+
+		switch batch.Operation {
+		case "download":
+			if !exists || size != ptr.Size {
+				obj.Error = &lfsObjectError{http.StatusNotFound, "Object does not exist"}
+				break
+			}
+			obj.Actions = map[string]*lfsAction{
+				"download": {Href: href, Header: header},
+			}
+		case "upload":
+			// Objects that are already stored do not need to be uploaded
+			if exists && size == ptr.Size {
+				break
+			}
+			obj.Actions = map[string]*lfsAction{
+				"upload": {Href: href, Header: header},
+				"verify": {Href: baseURL + "/objects/verify", Header: header},
+			}
+		}
+
+		resp.Objects = append(resp.Objects, obj)
+	}
+
+	writeLFSJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getLFSObject(_ string, w http.ResponseWriter, r *Request) {
+	f, err := os.Open(newLFSStorage(r.RepoPath).path(r.file))
+	if err != nil {
+		writeLFSJSON(w, http.StatusNotFound, lfsError{"Object does not exist"})
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		fail500(w, r.log, "lfs-download", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r.Request, "", stat.ModTime(), f)
+}
+
+func (s *Server) putLFSObject(_ string, w http.ResponseWriter, r *Request) {
+	err := newLFSStorage(r.RepoPath).put(r.file, r.Body)
+	if err == errLFSOidMismatch {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{err.Error()})
+		return
+	}
+	if err != nil {
+		fail500(w, r.log, "lfs-upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) postLFSVerify(_ string, w http.ResponseWriter, r *Request) {
+	ptr := lfsPointer{}
+	if err := json.NewDecoder(r.Body).Decode(&ptr); err != nil || !reLFSOid.MatchString(ptr.Oid) {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid object"})
+		return
+	}
+
+	size, exists := newLFSStorage(r.RepoPath).size(ptr.Oid)
+	if !exists {
+		writeLFSJSON(w, http.StatusNotFound, lfsError{"Object does not exist"})
+		return
+	}
+	if size != ptr.Size {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Object size does not match"})
+		return
+	}
+
+	writeLFSJSON(w, http.StatusOK, ptr)
+}
@@ -0,0 +1,359 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const lfsLocksDefaultLimit = 100
+
+var (
+	reLFSUnlock = regexp.MustCompile(`/info/lfs/locks/([0-9a-f-]{36})/unlock$`)
+
+	// lfsLocksMu guards read-modify-write cycles of lock files
+	lfsLocksMu sync.Mutex
+)
+
+type lfsLock struct {
+	ID       string       `json:"id"`
+	Path     string       `json:"path"`
+	LockedAt time.Time    `json:"locked_at"`
+	Owner    lfsLockOwner `json:"owner"`
+}
+
+type lfsLockOwner struct {
+	Name string `json:"name"`
+}
+
+type lfsLockRequest struct {
+	Path  string `json:"path"`
+	Force bool   `json:"force"`
+}
+
+type lfsLockResponse struct {
+	Lock    *lfsLock `json:"lock"`
+	Message string   `json:"message,omitempty"`
+}
+
+type lfsLockListResponse struct {
+	Locks      []lfsLock `json:"locks"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+type lfsLockVerifyRequest struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+type lfsLockVerifyResponse struct {
+	Ours       []lfsLock `json:"ours"`
+	Theirs     []lfsLock `json:"theirs"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// lfsLocksPath returns location of the repository locks file
+func lfsLocksPath(repoPath string) string {
+	return filepath.Join(repoPath, "lfs", "locks.json")
+}
+
+func readLFSLocks(repoPath string) ([]lfsLock, error) {
+	locks := []lfsLock{}
+
+	data, err := ioutil.ReadFile(lfsLocksPath(repoPath))
+	if os.IsNotExist(err) {
+		return locks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return locks, json.Unmarshal(data, &locks)
+}
+
+func writeLFSLocks(repoPath string, locks []lfsLock) error {
+	data, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+
+	filePath := lfsLocksPath(repoPath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never see partial content
+	if err := ioutil.WriteFile(filePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// cleanLockPath normalizes path of a locked file relative to repository root
+func cleanLockPath(p string) string {
+	p = path.Clean("/" + strings.TrimSpace(p))
+	return strings.TrimPrefix(p, "/")
+}
+
+// paginateLocks returns a page of locks starting at cursor and the next cursor
+func paginateLocks(locks []lfsLock, cursor string, limit int) ([]lfsLock, string) {
+	if limit <= 0 || limit > lfsLocksDefaultLimit {
+		limit = lfsLocksDefaultLimit
+	}
+
+	start := 0
+	if cursor != "" {
+		start = len(locks)
+		for i, lock := range locks {
+			if lock.ID == cursor {
+				start = i
+				break
+			}
+		}
+	}
+
+	end := start + limit
+	if end >= len(locks) {
+		return locks[start:], ""
+	}
+	return locks[start:end], locks[end].ID
+}
+
+// lockOwner returns name of the lock owner for the request identity
+func lockOwner(w http.ResponseWriter, r *Request) (string, bool) {
+	if r.Identity.Username == "" {
+		writeLFSJSON(w, http.StatusForbidden, lfsError{"Authentication is required for file locking"})
+		return "", false
+	}
+	return r.Identity.Username, true
+}
+
+func (s *Server) getLFSLocks(_ string, w http.ResponseWriter, r *Request) {
+	locks, err := readLFSLocks(r.RepoPath)
+	if err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	query := r.URL.Query()
+	filtered := []lfsLock{}
+	for _, lock := range locks {
+		if p := query.Get("path"); p != "" && lock.Path != cleanLockPath(p) {
+			continue
+		}
+		if id := query.Get("id"); id != "" && lock.ID != id {
+			continue
+		}
+		filtered = append(filtered, lock)
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, next := paginateLocks(filtered, query.Get("cursor"), limit)
+
+	writeLFSJSON(w, http.StatusOK, lfsLockListResponse{Locks: page, NextCursor: next})
+}
+
+func (s *Server) postLFSLock(_ string, w http.ResponseWriter, r *Request) {
+	owner, ok := lockOwner(w, r)
+	if !ok {
+		return
+	}
+
+	req := lfsLockRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || cleanLockPath(req.Path) == "" {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid lock request"})
+		return
+	}
+
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+
+	locks, err := readLFSLocks(r.RepoPath)
+	if err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	lockPath := cleanLockPath(req.Path)
+	for _, lock := range locks {
+		if lock.Path == lockPath {
+			writeLFSJSON(w, http.StatusConflict, lfsLockResponse{Lock: &lock, Message: "already created lock"})
+			return
+		}
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	lock := lfsLock{
+		ID:       id.String(),
+		Path:     lockPath,
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+		Owner:    lfsLockOwner{Name: owner},
+	}
+
+	if err := writeLFSLocks(r.RepoPath, append(locks, lock)); err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	writeLFSJSON(w, http.StatusCreated, lfsLockResponse{Lock: &lock})
+}
+
+func (s *Server) postLFSLocksVerify(_ string, w http.ResponseWriter, r *Request) {
+	owner, ok := lockOwner(w, r)
+	if !ok {
+		return
+	}
+
+	req := lfsLockVerifyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid verify request"})
+		return
+	}
+
+	locks, err := readLFSLocks(r.RepoPath)
+	if err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	page, next := paginateLocks(locks, req.Cursor, req.Limit)
+	resp := lfsLockVerifyResponse{Ours: []lfsLock{}, Theirs: []lfsLock{}, NextCursor: next}
+
+	for _, lock := range page {
+		if lock.Owner.Name == owner {
+			resp.Ours = append(resp.Ours, lock)
+		} else {
+			resp.Theirs = append(resp.Theirs, lock)
+		}
+	}
+
+	writeLFSJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) postLFSUnlock(_ string, w http.ResponseWriter, r *Request) {
+	owner, ok := lockOwner(w, r)
+	if !ok {
+		return
+	}
+
+	req := lfsLockRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, lfsError{"Invalid unlock request"})
+		return
+	}
+
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+
+	locks, err := readLFSLocks(r.RepoPath)
+	if err != nil {
+		fail500(w, r.log, "lfs-locks", err)
+		return
+	}
+
+	for i, lock := range locks {
+		if lock.ID != r.file {
+			continue
+		}
+
+		if lock.Owner.Name != owner && !req.Force {
+			writeLFSJSON(w, http.StatusForbidden, lfsLockResponse{Lock: &lock, Message: "lock is owned by another user"})
+			return
+		}
+
+		if lock.Owner.Name != owner && !s.forceUnlockAllowed(r) {
+			writeLFSJSON(w, http.StatusForbidden, lfsLockResponse{Lock: &lock, Message: "force unlock is not allowed"})
+			return
+		}
+
+		if err := writeLFSLocks(r.RepoPath, append(locks[:i:i], locks[i+1:]...)); err != nil {
+			fail500(w, r.log, "lfs-locks", err)
+			return
+		}
+
+		writeLFSJSON(w, http.StatusOK, lfsLockResponse{Lock: &lock})
+		return
+	}
+
+	writeLFSJSON(w, http.StatusNotFound, lfsError{"Lock does not exist"})
+}
+
+// forceUnlockAllowed checks whether the request identity could remove locks of other users
+func (s *Server) forceUnlockAllowed(r *Request) bool {
+	if s.ForceUnlockFunc == nil {
+		return false
+	}
+
+	allowed, err := s.ForceUnlockFunc(r.Identity, r.RepoName)
+	if err != nil {
+		r.log.Error("lfs-locks", "error", err)
+		return false
+	}
+	return allowed
+}
+
+// CheckLFSLocks returns an error if the ref update changes files locked by
+// anyone except the owner. It's meant to be used in ref policies or pre-receive
+// hooks, where the name of the pushing user is available in hook.User.
+func CheckLFSLocks(hook *HookInfo, owner string) error {
+	// Deleted refs do not change any files
+	if hook.NewRev == ZeroSHA {
+		return nil
+	}
+
+	locks, err := readLFSLocks(hook.RepoPath)
+	if err != nil || len(locks) == 0 {
+		return err
+	}
+
+	args := []string{"diff", "--name-only", hook.OldRev, hook.NewRev}
+	if hook.OldRev == ZeroSHA {
+		// Files changed by commits that are not reachable from existing refs
+		args = []string{"log", "--name-only", "--format=", hook.NewRev, "--not", "--all"}
+	}
+
+	env, err := hook.GitEnv()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = hook.RepoPath
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("cant list changed files: %v", err)
+	}
+
+	changed := map[string]bool{}
+	for _, name := range strings.Split(string(out), "\n") {
+		if name != "" {
+			changed[name] = true
+		}
+	}
+
+	for _, lock := range locks {
+		if changed[lock.Path] && lock.Owner.Name != owner {
+			return fmt.Errorf("%s is locked by %s", lock.Path, lock.Owner.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockRequest sends LFS locks API request on behalf of the user
+func lockRequest(t *testing.T, method string, url string, user string, body string, out interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Accept", lfsContentType)
+	req.Header.Set("Content-Type", lfsContentType)
+	req.SetBasicAuth(user, "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestLFSLocks(t *testing.T) {
+	server, ts := newTestServer(t, Config{AutoCreate: true, Auth: true, LFS: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			return cred.Password == "secret", nil
+		}
+		s.ForceUnlockFunc = func(identity Identity, repo string) (bool, error) {
+			return identity.Username == "admin", nil
+		}
+	})
+	api := ts.URL + "/test.git/info/lfs/locks"
+
+	created := lfsLockResponse{}
+	status := lockRequest(t, "POST", api, "alice", `{"path":"/assets/logo.psd"}`, &created)
+	assert.Equal(t, http.StatusCreated, status)
+	require.NotNil(t, created.Lock)
+	assert.Equal(t, "assets/logo.psd", created.Lock.Path)
+	assert.Equal(t, "alice", created.Lock.Owner.Name)
+
+	conflict := lfsLockResponse{}
+	status = lockRequest(t, "POST", api, "bob", `{"path":"assets/logo.psd"}`, &conflict)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, created.Lock.ID, conflict.Lock.ID)
+
+	status = lockRequest(t, "POST", api, "bob", `{"path":"assets/banner.psd"}`, nil)
+	assert.Equal(t, http.StatusCreated, status)
+
+	// Locks are stored on disk in the repository
+	assert.FileExists(t, filepath.Join(server.config.Dir, "test.git", "lfs", "locks.json"))
+
+	list := lfsLockListResponse{}
+	lockRequest(t, "GET", api, "bob", "", &list)
+	assert.Len(t, list.Locks, 2)
+
+	list = lfsLockListResponse{}
+	lockRequest(t, "GET", api+"?path=assets/logo.psd", "bob", "", &list)
+	require.Len(t, list.Locks, 1)
+	assert.Equal(t, created.Lock.ID, list.Locks[0].ID)
+
+	list = lfsLockListResponse{}
+	lockRequest(t, "GET", api+"?limit=1", "bob", "", &list)
+	assert.Len(t, list.Locks, 1)
+	require.NotEmpty(t, list.NextCursor)
+
+	cursor := list.NextCursor
+	list = lfsLockListResponse{}
+	lockRequest(t, "GET", api+"?cursor="+cursor, "bob", "", &list)
+	require.Len(t, list.Locks, 1)
+	assert.Equal(t, cursor, list.Locks[0].ID)
+	assert.Empty(t, list.NextCursor)
+
+	verify := lfsLockVerifyResponse{}
+	status = lockRequest(t, "POST", api+"/verify", "alice", `{"ref":{"name":"refs/heads/master"}}`, &verify)
+	assert.Equal(t, http.StatusOK, status)
+	require.Len(t, verify.Ours, 1)
+	require.Len(t, verify.Theirs, 1)
+	assert.Equal(t, "assets/logo.psd", verify.Ours[0].Path)
+	assert.Equal(t, "assets/banner.psd", verify.Theirs[0].Path)
+
+	// Only the owner can release the lock without force
+	unlock := api + "/" + created.Lock.ID + "/unlock"
+	status = lockRequest(t, "POST", unlock, "bob", `{}`, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status = lockRequest(t, "POST", unlock, "alice", `{}`, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	status = lockRequest(t, "POST", unlock, "alice", `{}`, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	list = lfsLockListResponse{}
+	lockRequest(t, "GET", api, "alice", "", &list)
+	require.Len(t, list.Locks, 1)
+
+	// Force unlock is limited to admins
+	unlock = api + "/" + list.Locks[0].ID + "/unlock"
+	status = lockRequest(t, "POST", unlock, "alice", `{"force":true}`, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status = lockRequest(t, "POST", unlock, "admin", `{"force":true}`, nil)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestLFSLocksRequireIdentity(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true, LFS: true})
+
+	status := lockRequest(t, "POST", ts.URL+"/test.git/info/lfs/locks", "alice", `{"path":"logo.psd"}`, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestCheckLFSLocks(t *testing.T) {
+	work := newWorkTree(t)
+	oldRev := strings.TrimSpace(mustGit(t, work, "rev-parse", "HEAD"))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "logo.psd"), []byte("image"), 0644))
+	mustGit(t, work, "add", "logo.psd")
+	mustGit(t, work, "commit", "-m", "Add logo")
+	newRev := strings.TrimSpace(mustGit(t, work, "rev-parse", "HEAD"))
+
+	hook := &HookInfo{RepoPath: work, OldRev: oldRev, NewRev: newRev, Ref: "refs/heads/master"}
+	assert.NoError(t, CheckLFSLocks(hook, "bob"))
+
+	locks := []lfsLock{{ID: "1", Path: "logo.psd", Owner: lfsLockOwner{Name: "alice"}}}
+	require.NoError(t, writeLFSLocks(work, locks))
+
+	assert.NoError(t, CheckLFSLocks(hook, "alice"))
+	assert.EqualError(t, CheckLFSLocks(hook, "bob"), "logo.psd is locked by alice")
+
+	hook.NewRev = ZeroSHA
+	assert.NoError(t, CheckLFSLocks(hook, "bob"))
+}
+
+func TestCheckLFSLocksPolicy(t *testing.T) {
+	policy := func(hook *HookInfo) error { return CheckLFSLocks(hook, "bob") }
+	server, ts := newTestServer(t, Config{AutoCreate: true, RefPolicies: []RefPolicy{policy}})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+
+	locks := []lfsLock{{ID: "1", Path: "logo.psd", Owner: lfsLockOwner{Name: "alice"}}}
+	require.NoError(t, writeLFSLocks(filepath.Join(server.config.Dir, "test.git"), locks))
+
+	// Pushed commits are only in quarantine while policies run
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "README"), []byte("updated"), 0644))
+	mustGit(t, work, "commit", "-am", "Update readme")
+	_, stderr, err := runGit(t, work, nil, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "logo.psd"), []byte("image"), 0644))
+	mustGit(t, work, "add", "logo.psd")
+	mustGit(t, work, "commit", "-m", "Add logo")
+	_, stderr, err = runGit(t, work, nil, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> master (logo.psd is locked by alice)")
+
+	_, stderr, err = runGit(t, work, nil, "push", url, "master:feature")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> feature (logo.psd is locked by alice)")
+}
@@ -0,0 +1,185 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lfsRequest sends LFS API request and decodes JSON response
+func lfsRequest(t *testing.T, method string, url string, body string, out interface{}) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Accept", lfsContentType)
+	req.Header.Set("Content-Type", lfsContentType)
+	req.SetBasicAuth("hello", "world")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp
+}
+
+func TestLFS(t *testing.T) {
+	operations := []Operation{}
+	_, ts := newTestServer(t, Config{AutoCreate: true, Auth: true, LFS: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			operations = append(operations, req.Operation)
+			return cred.Username == "hello", nil
+		}
+	})
+
+	content := "large file content"
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	api := ts.URL + "/test.git/info/lfs"
+
+	// Object is not uploaded yet
+	batch := lfsBatchResponse{}
+	resp := lfsRequest(t, "POST", api+"/objects/batch", `{"operation":"download","transfers":["basic"],"objects":[{"oid":"`+oid+`","size":18}]}`, &batch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, lfsContentType, resp.Header.Get("Content-Type"))
+	require.Len(t, batch.Objects, 1)
+	assert.Equal(t, 404, batch.Objects[0].Error.Code)
+	assert.Equal(t, ReadOperation, operations[0])
+
+	// Upload object
+	batch = lfsBatchResponse{}
+	lfsRequest(t, "POST", api+"/objects/batch", `{"operation":"upload","transfers":["basic"],"objects":[{"oid":"`+oid+`","size":18}, {"oid":"../../config","size":1}]}`, &batch)
+	assert.Equal(t, WriteOperation, operations[1])
+	assert.Equal(t, "basic", batch.Transfer)
+	require.Len(t, batch.Objects, 2)
+	assert.Equal(t, 422, batch.Objects[1].Error.Code)
+
+	upload := batch.Objects[0].Actions["upload"]
+	require.NotNil(t, upload)
+	assert.Equal(t, api+"/objects/"+oid, upload.Href)
+	assert.Equal(t, "Basic aGVsbG86d29ybGQ=", upload.Header["Authorization"])
+
+	resp = lfsRequest(t, "PUT", upload.Href, "corrupted content", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = lfsRequest(t, "PUT", upload.Href, content, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	verify := batch.Objects[0].Actions["verify"]
+	require.NotNil(t, verify)
+	resp = lfsRequest(t, "POST", verify.Href, `{"oid":"`+oid+`","size":18}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = lfsRequest(t, "POST", verify.Href, `{"oid":"`+oid+`","size":100}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	// Already uploaded objects do not need any actions
+	batch = lfsBatchResponse{}
+	lfsRequest(t, "POST", api+"/objects/batch", `{"operation":"upload","objects":[{"oid":"`+oid+`","size":18}]}`, &batch)
+	assert.Empty(t, batch.Objects[0].Actions)
+
+	// Download object
+	batch = lfsBatchResponse{}
+	lfsRequest(t, "POST", api+"/objects/batch", `{"operation":"download","objects":[{"oid":"`+oid+`","size":18}]}`, &batch)
+	download := batch.Objects[0].Actions["download"]
+	require.NotNil(t, download)
+
+	resp = lfsRequest(t, "GET", download.Href, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, _ := http.NewRequest("GET", download.Href, nil)
+	req.SetBasicAuth("hello", "world")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, content, string(data))
+
+	// Unauthenticated requests are rejected
+	resp, err = http.Post(api+"/objects/batch", lfsContentType, strings.NewReader(`{"operation":"download","objects":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func Test_lfsBatchAccess(t *testing.T) {
+	objects := `"objects":[{"oid":"` + strings.Repeat("a", 64) + `","size":1}]`
+	padding := `"ref":{"name":"` + strings.Repeat("a", lfsBatchPeekSize) + `"}`
+	cases := map[string]string{
+		`{"operation":"download",` + objects + `}`:       ServiceUploadPack,
+		`{"transfers":["basic"],"operation":"download"}`: ServiceUploadPack,
+		`{"operation":"upload",` + objects + `}`:         ServiceReceivePack,
+		`{` + padding + `,"operation":"download"}`:       ServiceReceivePack,
+		`not json`: ServiceReceivePack,
+	}
+
+	for body, expected := range cases {
+		req, err := http.NewRequest("POST", "/test.git/info/lfs/objects/batch", strings.NewReader(body))
+		require.NoError(t, err)
+		assert.Equal(t, expected, lfsBatchAccess(req), body)
+
+		// Body is restored for the handler
+		data, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(data))
+	}
+}
+
+func TestLFSBatchErrors(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true, LFS: true})
+	api := ts.URL + "/test.git/info/lfs/objects/batch"
+
+	resp := lfsRequest(t, "POST", api, `{"operation":"delete","objects":[]}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = lfsRequest(t, "POST", api, `{"operation":"upload","transfers":["tus"],"objects":[]}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = lfsRequest(t, "POST", api, `{"operation":"upload","hash_algo":"md5","objects":[]}`, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = lfsRequest(t, "POST", api, `{"operation":"download","objects":[],"ref":{"name":"`+strings.Repeat("a", lfsMaxBatchSize)+`"}}`, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestLFSDisabled(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true})
+
+	resp := lfsRequest(t, "POST", ts.URL+"/test.git/info/lfs/objects/batch", `{"operation":"download","objects":[]}`, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestLFSClient(t *testing.T) {
+	if _, err := exec.LookPath("git-lfs"); err != nil {
+		t.Skip("git-lfs is not installed")
+	}
+
+	_, ts := newTestServer(t, Config{AutoCreate: true, LFS: true})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "lfs", "install", "--local")
+	mustGit(t, work, "lfs", "track", "*.bin")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "data.bin"), []byte("binary content"), 0644))
+	mustGit(t, work, "add", ".gitattributes", "data.bin")
+	mustGit(t, work, "commit", "-m", "Add binary")
+	mustGit(t, work, "push", url, "master")
+
+	dest := t.TempDir()
+	mustGit(t, dest, "clone", url, "clone")
+	clone := filepath.Join(dest, "clone")
+	mustGit(t, clone, "lfs", "install", "--local")
+	mustGit(t, clone, "lfs", "pull")
+
+	data, err := ioutil.ReadFile(filepath.Join(clone, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary content", string(data))
+}
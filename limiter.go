@@ -0,0 +1,145 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrTooManyRequests = errors.New("too many concurrent requests, try again later")
+
+// Limits restricts how many git processes could run at the same time on a
+// server. Zero value means no limit.
+type Limits struct {
+	Global      int           // Total number of processes
+	PerRepo     int           // Number of processes per repository
+	PerIdentity int           // Number of processes per authenticated identity
+	MaxWait     time.Duration // How long requests over the limit wait for a free slot
+}
+
+// limiter is a set of semaphores for concurrent git processes
+type limiter struct {
+	limits     Limits
+	global     chan struct{}
+	mu         sync.Mutex
+	repos      map[string]*semaphore
+	identities map[string]*semaphore
+}
+
+// semaphore is a shared per-key semaphore with a number of users
+type semaphore struct {
+	slots chan struct{}
+	refs  int
+}
+
+func newLimiter(limits Limits) *limiter {
+	l := &limiter{
+		limits:     limits,
+		repos:      map[string]*semaphore{},
+		identities: map[string]*semaphore{},
+	}
+	if limits.Global > 0 {
+		l.global = make(chan struct{}, limits.Global)
+	}
+	return l
+}
+
+// acquire waits for a free slot for the repository and identity. Returned
+// function must be called to release the slot once git process is done.
+func (l *limiter) acquire(ctx context.Context, repo string, identity Identity) (func(), error) {
+	var timeout <-chan time.Time
+	if l.limits.MaxWait > 0 {
+		timer := time.NewTimer(l.limits.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	releases := []func(){}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	if key := identity.key(); key != "" && l.limits.PerIdentity > 0 {
+		done, err := l.acquireKey(ctx, timeout, l.identities, key, l.limits.PerIdentity)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, done)
+	}
+
+	if l.limits.PerRepo > 0 {
+		done, err := l.acquireKey(ctx, timeout, l.repos, repo, l.limits.PerRepo)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, done)
+	}
+
+	if l.global != nil {
+		if err := wait(ctx, timeout, l.global); err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, func() { <-l.global })
+	}
+
+	return release, nil
+}
+
+// acquireKey takes a slot from the semaphore registered for the key
+func (l *limiter) acquireKey(ctx context.Context, timeout <-chan time.Time, sems map[string]*semaphore, key string, size int) (func(), error) {
+	l.mu.Lock()
+	sem, ok := sems[key]
+	if !ok {
+		sem = &semaphore{slots: make(chan struct{}, size)}
+		sems[key] = sem
+	}
+	sem.refs++
+	l.mu.Unlock()
+
+	unref := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		sem.refs--
+		if sem.refs == 0 {
+			delete(sems, key)
+		}
+	}
+
+	if err := wait(ctx, timeout, sem.slots); err != nil {
+		unref()
+		return nil, err
+	}
+
+	return func() {
+		<-sem.slots
+		unref()
+	}, nil
+}
+
+// wait takes a slot from the channel, giving up after timeout
+func wait(ctx context.Context, timeout <-chan time.Time, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout == nil {
+		return ErrTooManyRequests
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrTooManyRequests
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterGlobal(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a.git", Identity{})
+	require.NoError(t, err)
+
+	_, err = l.acquire(ctx, "b.git", Identity{})
+	assert.Equal(t, ErrTooManyRequests, err)
+
+	release()
+
+	release, err = l.acquire(ctx, "b.git", Identity{})
+	require.NoError(t, err)
+	release()
+}
+
+func TestLimiterPerRepo(t *testing.T) {
+	l := newLimiter(Limits{PerRepo: 1})
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a.git", Identity{})
+	require.NoError(t, err)
+
+	_, err = l.acquire(ctx, "a.git", Identity{})
+	assert.Equal(t, ErrTooManyRequests, err)
+
+	other, err := l.acquire(ctx, "b.git", Identity{})
+	require.NoError(t, err)
+
+	release()
+	other()
+	assert.Empty(t, l.repos)
+}
+
+func TestLimiterPerIdentity(t *testing.T) {
+	l := newLimiter(Limits{PerIdentity: 1})
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a.git", Identity{Username: "hello"})
+	require.NoError(t, err)
+	defer release()
+
+	_, err = l.acquire(ctx, "b.git", Identity{Username: "hello"})
+	assert.Equal(t, ErrTooManyRequests, err)
+
+	other, err := l.acquire(ctx, "b.git", Identity{KeyID: "hello"})
+	require.NoError(t, err)
+	other()
+
+	// Anonymous requests are not limited per identity
+	for i := 0; i < 2; i++ {
+		anon, err := l.acquire(ctx, "a.git", Identity{})
+		require.NoError(t, err)
+		defer anon()
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := newLimiter(Limits{PerRepo: 1, Global: 1, MaxWait: time.Second})
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a.git", Identity{})
+	require.NoError(t, err)
+
+	time.AfterFunc(100*time.Millisecond, release)
+
+	release, err = l.acquire(ctx, "a.git", Identity{})
+	require.NoError(t, err)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err = l.acquire(cancelCtx, "a.git", Identity{})
+	assert.Equal(t, context.Canceled, err)
+
+	release()
+	assert.Empty(t, l.repos)
+}
+
+func TestLimitsHTTP(t *testing.T) {
+	gitPath, _ := newSlowGit(t)
+	server, ts := newTestServer(t, Config{GitPath: gitPath, Limits: Limits{PerRepo: 1}})
+	require.NoError(t, os.MkdirAll(filepath.Join(server.config.Dir, "test.git", "objects"), 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, "POST", ts.URL+"/test.git/git-upload-pack", strings.NewReader("0000"))
+		http.DefaultClient.Do(req)
+	}()
+
+	require.Eventually(t, func() bool {
+		server.limiter.mu.Lock()
+		defer server.limiter.mu.Unlock()
+		return len(server.limiter.repos) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
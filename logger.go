@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Logger is a leveled structured logger used by HTTP and SSH servers.
+// Fields are passed as alternating key and value pairs, e.g. "repo", "test.git".
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// StdLogger writes log entries to a standard library logger
+type StdLogger struct {
+	Logger *log.Logger // Logger to write to, defaults to standard logger
+}
+
+var defaultLogger Logger = StdLogger{}
+
+func (l StdLogger) Debug(msg string, fields ...interface{}) { l.print(msg, fields) }
+func (l StdLogger) Info(msg string, fields ...interface{})  { l.print(msg, fields) }
+func (l StdLogger) Warn(msg string, fields ...interface{})  { l.print(msg, fields) }
+func (l StdLogger) Error(msg string, fields ...interface{}) { l.print(msg, fields) }
+
+func (l StdLogger) print(msg string, fields []interface{}) {
+	line := msg + formatFields(fields)
+	if l.Logger != nil {
+		l.Logger.Println(line)
+		return
+	}
+	log.Println(line)
+}
+
+// formatFields renders key/value pairs as logfmt string
+func formatFields(fields []interface{}) string {
+	sb := strings.Builder{}
+
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := "<missing>"
+		if i+1 < len(fields) {
+			value = fmt.Sprint(fields[i+1])
+		}
+
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+
+		sb.WriteString(" " + key + "=" + value)
+	}
+
+	return sb.String()
+}
+
+// fieldLogger adds predefined fields to every log entry
+type fieldLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+// withFields returns a logger that includes given fields in every entry
+func withFields(l Logger, fields ...interface{}) Logger {
+	if fl, ok := l.(fieldLogger); ok {
+		return fieldLogger{fl.logger, append(append([]interface{}{}, fl.fields...), fields...)}
+	}
+	return fieldLogger{l, fields}
+}
+
+func (l fieldLogger) Debug(msg string, fields ...interface{}) {
+	l.logger.Debug(msg, append(fields, l.fields...)...)
+}
+
+func (l fieldLogger) Info(msg string, fields ...interface{}) {
+	l.logger.Info(msg, append(fields, l.fields...)...)
+}
+
+func (l fieldLogger) Warn(msg string, fields ...interface{}) {
+	l.logger.Warn(msg, append(fields, l.fields...)...)
+}
+
+func (l fieldLogger) Error(msg string, fields ...interface{}) {
+	l.logger.Error(msg, append(fields, l.fields...)...)
+}
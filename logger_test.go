@@ -0,0 +1,25 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_formatFields(t *testing.T) {
+	assert.Equal(t, "", formatFields(nil))
+	assert.Equal(t, " repo=test.git", formatFields([]interface{}{"repo", "test.git"}))
+	assert.Equal(t, ` error="exit status 1" user=""`, formatFields([]interface{}{"error", errors.New("exit status 1"), "user", ""}))
+	assert.Equal(t, " odd=<missing>", formatFields([]interface{}{"odd"}))
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger := StdLogger{Logger: log.New(buf, "", 0)}
+
+	logger.Info("request", "method", "GET", "repo", "test.git")
+	assert.Equal(t, "request method=GET repo=test.git\n", buf.String())
+}
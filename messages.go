@@ -0,0 +1,144 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sosedoff/gitkit/pktline"
+)
+
+// RejectError rejects a request with a message for the git client. It could be
+// returned from auth callbacks, authorizers and ref policies. Clients show the
+// message as "fatal: remote error:" output.
+type RejectError struct {
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// Reject returns a RejectError with a formatted message
+func Reject(format string, args ...interface{}) error {
+	return &RejectError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Notice is an informational message for the git client. Returned from auth
+// callbacks or authorizers along with a positive decision, it lets the request
+// through and the message is shown as "remote:" output. With a negative
+// decision it's used as a rejection message.
+type Notice struct {
+	Message string
+}
+
+func (n *Notice) Error() string {
+	return n.Message
+}
+
+// Notify returns a Notice with a formatted message
+func Notify(format string, args ...interface{}) error {
+	return &Notice{Message: fmt.Sprintf(format, args...)}
+}
+
+// clientMessage returns the message for git clients carried by the error
+func clientMessage(err error) (string, bool) {
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		return reject.Message, true
+	}
+
+	var notice *Notice
+	if errors.As(err, &notice) {
+		return notice.Message, true
+	}
+
+	return "", false
+}
+
+// isNotice returns true if the error only carries a notice for the client
+func isNotice(err error) bool {
+	var notice *Notice
+	return errors.As(err, &notice)
+}
+
+// noticeWriter injects notices into git output right before the first
+// side-band packet, so clients show them as "remote:" lines. Output that
+// does not use side-band is passed through unchanged.
+type noticeWriter struct {
+	w       io.Writer
+	notices []string
+	buf     []byte
+	done    bool
+}
+
+func newNoticeWriter(w io.Writer, notices []string) io.Writer {
+	if len(notices) == 0 {
+		return w
+	}
+	return &noticeWriter{w: w, notices: notices}
+}
+
+func (n *noticeWriter) Write(p []byte) (int, error) {
+	if n.done {
+		return n.w.Write(p)
+	}
+
+	n.buf = append(n.buf, p...)
+	if err := n.scan(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// scan writes out complete packets until it finds the first side-band packet
+func (n *noticeWriter) scan() error {
+	for len(n.buf) >= pktline.LengthSize {
+		size, err := strconv.ParseUint(string(n.buf[:pktline.LengthSize]), 16, 16)
+		if err != nil {
+			// Not a pkt-line stream, like pack data without side-band
+			return n.finish(false)
+		}
+
+		if size > pktline.LengthSize {
+			if len(n.buf) <= pktline.LengthSize {
+				return nil
+			}
+			if band := n.buf[pktline.LengthSize]; band >= pktline.BandData && band <= pktline.BandError {
+				return n.finish(true)
+			}
+		} else {
+			size = pktline.LengthSize
+		}
+
+		if uint64(len(n.buf)) < size {
+			return nil
+		}
+
+		if _, err := n.w.Write(n.buf[:size]); err != nil {
+			return err
+		}
+		n.buf = n.buf[size:]
+	}
+
+	return nil
+}
+
+// finish writes notices if needed and switches to pass-through mode
+func (n *noticeWriter) finish(sideband bool) error {
+	n.done = true
+
+	if sideband {
+		enc := pktline.NewEncoder(n.w)
+		for _, notice := range n.notices {
+			if err := enc.Sideband(pktline.BandProgress, pktline.SmallSidebandData, []byte(notice+"\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := n.w.Write(n.buf)
+	n.buf = nil
+	return err
+}
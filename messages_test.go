@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// messageAuthorizer rejects pushes and sends a notice on fetches
+var messageAuthorizer = AuthorizerFunc(func(identity Identity, repo string, service string) (bool, error) {
+	if service == ServiceReceivePack {
+		return false, Reject("%s is archived", repo)
+	}
+	return true, Notify("maintenance at 5pm")
+})
+
+func Test_clientMessage(t *testing.T) {
+	message, ok := clientMessage(Reject("no access to %s", "repo.git"))
+	assert.True(t, ok)
+	assert.Equal(t, "no access to repo.git", message)
+
+	message, ok = clientMessage(fmt.Errorf("wrapped: %w", Notify("hello")))
+	assert.True(t, ok)
+	assert.Equal(t, "hello", message)
+	assert.True(t, isNotice(Notify("hello")))
+	assert.False(t, isNotice(Reject("hello")))
+
+	_, ok = clientMessage(fmt.Errorf("database is down"))
+	assert.False(t, ok)
+
+	_, ok = clientMessage(nil)
+	assert.False(t, ok)
+}
+
+func Test_noticeWriter(t *testing.T) {
+	stream := "0008NAK\n" + "0000" + "000a\x01PACK\n" + "000c\x02progress"
+
+	// Output is written in small chunks to split packets
+	out := bytes.NewBuffer(nil)
+	w := newNoticeWriter(out, []string{"hello"})
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		n, err := w.Write([]byte(stream[i:end]))
+		require.NoError(t, err)
+		assert.Equal(t, end-i, n)
+	}
+	assert.Equal(t, "0008NAK\n"+"0000"+"000b\x02hello\n"+"000a\x01PACK\n"+"000c\x02progress", out.String())
+
+	// Pack data without side-band is not changed
+	out.Reset()
+	w = newNoticeWriter(out, []string{"hello"})
+	w.Write([]byte("0008NAK\nPACK"))
+	assert.Equal(t, "0008NAK\nPACK", out.String())
+
+	assert.Equal(t, out, newNoticeWriter(out, nil))
+}
+
+func TestMessagesHTTP(t *testing.T) {
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--bare", "test.git")
+
+	_, ts := newTestServer(t, Config{Dir: dir}, func(s *Server) {
+		s.Authorizer = messageAuthorizer
+	})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, nil, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "fatal: remote error: test.git is archived")
+
+	mustGit(t, dir, "--git-dir", "test.git", "fetch", work, "master:master")
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, nil, "clone", url, "clone")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "remote: maintenance at 5pm")
+}
+
+func TestMessagesAuthFunc(t *testing.T) {
+	_, ts := newTestServer(t, Config{AutoCreate: true, Auth: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			return false, Reject("password of %s has expired", cred.Username)
+		}
+	})
+
+	_, stderr, err := runGit(t, t.TempDir(), nil, "ls-remote", "http://hello:world@"+ts.Listener.Addr().String()+"/test.git")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "fatal: remote error: password of hello has expired")
+}
+
+func TestMessagesSSH(t *testing.T) {
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--bare", "test.git")
+
+	_, port := newTestSSH(t, Config{Dir: dir}, func(s *SSH) {
+		s.Authorizer = messageAuthorizer
+	})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "fatal: remote error: test.git is archived")
+
+	mustGit(t, dir, "--git-dir", "test.git", "fetch", work, "master:master")
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, env, "clone", url, "clone")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "remote: maintenance at 5pm")
+}
@@ -0,0 +1,82 @@
+package gitkit
+
+import "sync"
+
+// AccessMode controls which git services are available for a repository
+type AccessMode int
+
+const (
+	ModeReadWrite   AccessMode = iota // All services are available
+	ModeReadOnly                      // Pushes are rejected
+	ModeMaintenance                   // Pushes are rejected while repository is maintained
+)
+
+// defaultModeMessages are shown to clients when no custom message is set
+var defaultModeMessages = map[AccessMode]string{
+	ModeReadOnly:    "repository is read-only",
+	ModeMaintenance: "repository is under maintenance, pushes are temporarily disabled",
+}
+
+// Modes holds server-wide and per-repository access modes. Modes could be
+// changed at runtime and are safe for concurrent use. Zero value is ready to use.
+type Modes struct {
+	mu     sync.RWMutex
+	global modeState
+	repos  map[string]modeState
+}
+
+type modeState struct {
+	mode    AccessMode
+	message string
+}
+
+// SetGlobal changes the mode of all repositories. Per-repository modes are
+// only used while the server-wide mode is ModeReadWrite.
+func (m *Modes) SetGlobal(mode AccessMode, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.global = modeState{mode: mode, message: message}
+}
+
+// Set changes the mode of a single repository
+func (m *Modes) Set(repo string, mode AccessMode, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mode == ModeReadWrite {
+		delete(m.repos, repo)
+		return
+	}
+
+	if m.repos == nil {
+		m.repos = map[string]modeState{}
+	}
+	m.repos[repo] = modeState{mode: mode, message: message}
+}
+
+// Get returns the effective mode of the repository and a message for clients
+func (m *Modes) Get(repo string) (AccessMode, string) {
+	if m == nil {
+		return ModeReadWrite, ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state := m.global
+	if state.mode == ModeReadWrite {
+		state = m.repos[repo]
+	}
+
+	if state.message == "" {
+		state.message = defaultModeMessages[state.mode]
+	}
+	return state.mode, state.message
+}
+
+// pushBlocked returns a message for clients if pushes to the repository are disabled
+func (m *Modes) pushBlocked(repo string) (string, bool) {
+	mode, message := m.Get(repo)
+	return message, mode != ModeReadWrite
+}
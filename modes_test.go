@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModes(t *testing.T) {
+	var nilModes *Modes
+	mode, _ := nilModes.Get("repo.git")
+	assert.Equal(t, ModeReadWrite, mode)
+
+	modes := &Modes{}
+	modes.Set("repo.git", ModeReadOnly, "")
+
+	mode, message := modes.Get("repo.git")
+	assert.Equal(t, ModeReadOnly, mode)
+	assert.Equal(t, "repository is read-only", message)
+
+	mode, _ = modes.Get("other.git")
+	assert.Equal(t, ModeReadWrite, mode)
+
+	// Server-wide mode takes precedence
+	modes.SetGlobal(ModeMaintenance, "maintenance until 5pm")
+	mode, message = modes.Get("repo.git")
+	assert.Equal(t, ModeMaintenance, mode)
+	assert.Equal(t, "maintenance until 5pm", message)
+
+	modes.SetGlobal(ModeReadWrite, "")
+	modes.Set("repo.git", ModeReadWrite, "")
+	mode, message = modes.Get("repo.git")
+	assert.Equal(t, ModeReadWrite, mode)
+	assert.Empty(t, message)
+}
+
+func TestModesHTTP(t *testing.T) {
+	modes := &Modes{}
+	_, ts := newTestServer(t, Config{AutoCreate: true, Modes: modes})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+
+	modes.SetGlobal(ModeMaintenance, "maintenance until 5pm")
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit")
+
+	_, stderr, err := runGit(t, work, nil, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "remote: maintenance until 5pm")
+
+	// Clones keep working
+	dest := t.TempDir()
+	mustGit(t, dest, "clone", url, "clone")
+
+	modes.SetGlobal(ModeReadWrite, "")
+	mustGit(t, work, "push", url, "master")
+}
+
+func TestModesSSH(t *testing.T) {
+	modes := &Modes{}
+	_, port := newTestSSH(t, Config{AutoCreate: true, Modes: modes})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	modes.Set("test.git", ModeReadOnly, "")
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit")
+
+	_, stderr, err = runGit(t, work, env, "push", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "fatal: remote error: repository is read-only")
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, env, "clone", url, "clone")
+	assert.NoError(t, err, stderr)
+}
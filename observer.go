@@ -0,0 +1,118 @@
+package gitkit
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// Transports that serve git services
+const (
+	TransportHTTP = "http"
+	TransportSSH  = "ssh"
+)
+
+// Event describes a single git service call
+type Event struct {
+	Transport  string        // Transport used by the client, http or ssh
+	Repo       string        // Repository name
+	Service    string        // Git service, e.g. upload-pack
+	Identity   Identity      // Authenticated identity, empty for anonymous access
+	RemoteAddr string        // Client network address
+	Advertise  bool          // Set for HTTP ref advertisement requests
+	StartedAt  time.Time     // Time when the call has started
+	Duration   time.Duration // Total duration of the call, set when finished
+	BytesIn    int64         // Number of bytes received from the client
+	BytesOut   int64         // Number of bytes sent to the client
+	ExitStatus int           // Exit status of git process, -1 if it did not exit
+	Err        error         // Error that terminated the call, if any
+}
+
+// Observer receives events about git service calls. It could be used to
+// collect metrics or audit logs. Methods are called synchronously, so they
+// should not block.
+type Observer interface {
+	ServiceStarted(event Event)
+	ServiceFinished(event Event)
+}
+
+// observation tracks a single service call for an observer
+type observation struct {
+	observer Observer
+	event    Event
+	in       *countingReader
+	out      *countingWriter
+}
+
+// observe notifies observer about a started service call. Reader and writer
+// of the client connection are wrapped to count transferred bytes.
+func observe(observer Observer, event Event, in io.Reader, out io.Writer) *observation {
+	event.StartedAt = time.Now()
+	event.ExitStatus = -1
+
+	o := &observation{
+		observer: observer,
+		event:    event,
+		in:       &countingReader{r: in},
+		out:      &countingWriter{w: out},
+	}
+
+	if observer != nil {
+		observer.ServiceStarted(o.event)
+	}
+	return o
+}
+
+// finish notifies observer about a finished service call
+func (o *observation) finish(err error) {
+	o.event.Duration = time.Since(o.event.StartedAt)
+	o.event.BytesIn = atomic.LoadInt64(&o.in.n)
+	o.event.BytesOut = atomic.LoadInt64(&o.out.n)
+	o.event.Err = err
+
+	if o.observer != nil {
+		o.observer.ServiceFinished(o.event)
+	}
+}
+
+// exited records exit status of git process
+func (o *observation) exited(err error) {
+	o.event.ExitStatus = exitCode(err)
+}
+
+// exitCode returns process exit code for an error returned by exec.Cmd.Wait
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
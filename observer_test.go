@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	started  []Event
+	finished []Event
+}
+
+func (o *recordingObserver) ServiceStarted(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.started = append(o.started, e)
+}
+
+func (o *recordingObserver) ServiceFinished(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finished = append(o.finished, e)
+}
+
+// find returns finished events for a given service
+func (o *recordingObserver) find(service string, advertise bool) []Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result := []Event{}
+	for _, e := range o.finished {
+		if e.Service == service && e.Advertise == advertise {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func Test_exitCode(t *testing.T) {
+	assert.Equal(t, 0, exitCode(nil))
+	assert.Equal(t, -1, exitCode(fmt.Errorf("failed")))
+	assert.Equal(t, 3, exitCode(exec.Command("sh", "-c", "exit 3").Run()))
+}
+
+func TestObserverHTTP(t *testing.T) {
+	observer := &recordingObserver{}
+	_, ts := newTestServer(t, Config{AutoCreate: true}, func(s *Server) {
+		s.Observer = observer
+	})
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", ts.URL+"/test.git", "master")
+	mustGit(t, t.TempDir(), "clone", ts.URL+"/test.git", "clone")
+
+	assert.Equal(t, len(observer.started), len(observer.finished))
+
+	pushes := observer.find(ServiceReceivePack, false)
+	require.Len(t, pushes, 1)
+	assert.Equal(t, TransportHTTP, pushes[0].Transport)
+	assert.Equal(t, "test.git", pushes[0].Repo)
+	assert.Equal(t, 0, pushes[0].ExitStatus)
+	assert.NoError(t, pushes[0].Err)
+	assert.NotZero(t, pushes[0].BytesIn)
+	assert.NotZero(t, pushes[0].BytesOut)
+	assert.NotZero(t, pushes[0].Duration)
+
+	fetches := observer.find(ServiceUploadPack, false)
+	require.NotEmpty(t, fetches)
+	assert.NotZero(t, fetches[0].BytesIn)
+	assert.NotZero(t, fetches[0].BytesOut)
+
+	adverts := observer.find(ServiceUploadPack, true)
+	require.Len(t, adverts, 1)
+	assert.Zero(t, adverts[0].BytesIn)
+	assert.NotZero(t, adverts[0].BytesOut)
+}
+
+func TestObserverSSH(t *testing.T) {
+	observer := &recordingObserver{}
+	_, port := newTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.Observer = observer
+	})
+
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	_, stderr, err = runGit(t, t.TempDir(), env, "clone", url, "clone")
+	require.NoError(t, err, stderr)
+
+	for _, service := range []string{ServiceReceivePack, ServiceUploadPack} {
+		events := observer.find(service, false)
+		require.Len(t, events, 1, service)
+		assert.Equal(t, TransportSSH, events[0].Transport)
+		assert.Equal(t, "test.git", events[0].Repo)
+		assert.Equal(t, 0, events[0].ExitStatus)
+		assert.NotZero(t, events[0].BytesIn)
+		assert.NotZero(t, events[0].BytesOut)
+	}
+}
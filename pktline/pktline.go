@@ -0,0 +1,268 @@
+// Package pktline implements the pkt-line format used by git wire protocols.
+// See https://git-scm.com/docs/protocol-common#_pkt_line_format for details.
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	LengthSize        = 4                          // Size of the packet length prefix
+	MaxPacketSize     = 65520                      // Maximum size of a packet, including length
+	MaxPayloadSize    = MaxPacketSize - LengthSize // Maximum size of packet data
+	MaxSidebandData   = MaxPayloadSize - 1         // Maximum data size of a side-band-64k packet
+	SmallSidebandData = 1000 - LengthSize - 1      // Maximum data size of a side-band packet
+)
+
+// Side-band channels
+const (
+	BandData     byte = 1 // Pack or other command data
+	BandProgress byte = 2 // Progress messages shown as "remote:" lines
+	BandError    byte = 3 // Fatal error message
+)
+
+// PacketType describes the kind of a packet
+type PacketType int
+
+const (
+	Data        PacketType = iota // Packet with payload
+	Flush                         // 0000, end of a message
+	Delim                         // 0001, end of a message section in protocol v2
+	ResponseEnd                   // 0002, end of a response in stateless protocol v2
+)
+
+var (
+	ErrPayloadTooLarge = errors.New("pktline: payload is too large")
+	ErrInvalidLength   = errors.New("pktline: invalid packet length")
+	ErrInvalidBand     = errors.New("pktline: invalid side-band packet")
+)
+
+var specialPackets = map[PacketType][]byte{
+	Flush:       []byte("0000"),
+	Delim:       []byte("0001"),
+	ResponseEnd: []byte("0002"),
+}
+
+// Encoder writes packets to an output stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes payload as a single data packet
+func (e *Encoder) Encode(payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+
+	packet := make([]byte, LengthSize+len(payload))
+	copy(packet, fmt.Sprintf("%04x", len(packet)))
+	copy(packet[LengthSize:], payload)
+
+	_, err := e.w.Write(packet)
+	return err
+}
+
+// EncodeString writes s as a single data packet
+func (e *Encoder) EncodeString(s string) error {
+	return e.Encode([]byte(s))
+}
+
+// Encodef writes a formatted data packet
+func (e *Encoder) Encodef(format string, args ...interface{}) error {
+	return e.EncodeString(fmt.Sprintf(format, args...))
+}
+
+// Flush writes a flush packet
+func (e *Encoder) Flush() error {
+	return e.special(Flush)
+}
+
+// Delim writes a delimiter packet
+func (e *Encoder) Delim() error {
+	return e.special(Delim)
+}
+
+// ResponseEnd writes a response end packet
+func (e *Encoder) ResponseEnd() error {
+	return e.special(ResponseEnd)
+}
+
+// Error writes an ERR packet, which git clients show as a fatal remote error
+func (e *Encoder) Error(message string) error {
+	return e.EncodeString("ERR " + message + "\n")
+}
+
+// Sideband writes data to a side-band channel, split into packets of up to
+// size bytes of data. Use MaxSidebandData for side-band-64k capability and
+// SmallSidebandData for side-band.
+func (e *Encoder) Sideband(band byte, size int, data []byte) error {
+	if size <= 0 || size > MaxSidebandData {
+		size = MaxSidebandData
+	}
+
+	packet := make([]byte, 0, size+1)
+	for len(data) > 0 {
+		n := size
+		if len(data) < n {
+			n = len(data)
+		}
+
+		packet = append(append(packet[:0], band), data[:n]...)
+		if err := e.Encode(packet); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+func (e *Encoder) special(typ PacketType) error {
+	_, err := e.w.Write(specialPackets[typ])
+	return err
+}
+
+// SidebandWriter is an io.Writer that sends all writes to a side-band channel
+type SidebandWriter struct {
+	enc  *Encoder
+	band byte
+	size int
+}
+
+// NewSidebandWriter returns a writer for the side-band channel, see Encoder.Sideband
+func NewSidebandWriter(w io.Writer, band byte, size int) *SidebandWriter {
+	return &SidebandWriter{enc: NewEncoder(w), band: band, size: size}
+}
+
+func (w *SidebandWriter) Write(p []byte) (int, error) {
+	if err := w.enc.Sideband(w.band, w.size, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Scanner reads packets from an input stream. It never reads past the end of
+// the current packet, so the rest of the stream could be consumed directly.
+type Scanner struct {
+	r       io.Reader
+	typ     PacketType
+	raw     []byte
+	payload []byte
+	err     error
+}
+
+// NewScanner returns a new scanner that reads from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: r}
+}
+
+// Scan reads the next packet. It returns false at the end of input or on
+// error, which is available from Err.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	head := make([]byte, LengthSize)
+	if _, err := io.ReadFull(s.r, head); err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		return false
+	}
+
+	size, err := parseLength(head)
+	if err != nil {
+		s.err = err
+		return false
+	}
+
+	switch size {
+	case 0:
+		s.typ, s.raw, s.payload = Flush, head, nil
+		return true
+	case 1:
+		s.typ, s.raw, s.payload = Delim, head, nil
+		return true
+	case 2:
+		s.typ, s.raw, s.payload = ResponseEnd, head, nil
+		return true
+	}
+
+	raw := make([]byte, size)
+	copy(raw, head)
+	if _, err := io.ReadFull(s.r, raw[LengthSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+		return false
+	}
+
+	s.typ, s.raw, s.payload = Data, raw, raw[LengthSize:]
+	return true
+}
+
+// Type returns the type of the last packet
+func (s *Scanner) Type() PacketType {
+	return s.typ
+}
+
+// Bytes returns payload of the last packet, nil for special packets
+func (s *Scanner) Bytes() []byte {
+	return s.payload
+}
+
+// Text returns payload of the last packet as a string
+func (s *Scanner) Text() string {
+	return string(s.payload)
+}
+
+// Raw returns the last packet as it was read, including its length
+func (s *Scanner) Raw() []byte {
+	return s.raw
+}
+
+// Err returns the first error encountered by the scanner
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+func parseLength(head []byte) (int, error) {
+	size, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLength, head)
+	}
+
+	// Length 3 is reserved and 4 is a data packet without payload
+	if size == 3 || size > MaxPacketSize {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLength, head)
+	}
+
+	return int(size), nil
+}
+
+// ErrorMessage returns the message of an ERR packet payload
+func ErrorMessage(payload []byte) (string, bool) {
+	if !bytes.HasPrefix(payload, []byte("ERR ")) {
+		return "", false
+	}
+	return string(bytes.TrimSuffix(payload[4:], []byte("\n"))), true
+}
+
+// SplitSideband returns side-band channel and data of a packet payload
+func SplitSideband(payload []byte) (byte, []byte, error) {
+	if len(payload) == 0 || payload[0] < BandData || payload[0] > BandError {
+		return 0, nil, ErrInvalidBand
+	}
+	return payload[0], payload[1:], nil
+}
@@ -0,0 +1,175 @@
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoder(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoder(buf)
+
+	require.NoError(t, enc.EncodeString("# service=git-upload-pack\n"))
+	require.NoError(t, enc.Flush())
+	require.NoError(t, enc.Encodef("command=%s\n", "ls-refs"))
+	require.NoError(t, enc.Delim())
+	require.NoError(t, enc.ResponseEnd())
+	require.NoError(t, enc.Error("access denied"))
+
+	expected := "001e# service=git-upload-pack\n0000" + "0014command=ls-refs\n" + "0001" + "0002" + "0016ERR access denied\n"
+	assert.Equal(t, expected, buf.String())
+
+	assert.NoError(t, enc.Encode(make([]byte, MaxPayloadSize)))
+	assert.Equal(t, ErrPayloadTooLarge, enc.Encode(make([]byte, MaxPayloadSize+1)))
+}
+
+func TestEncoder_Sideband(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, NewEncoder(buf).Sideband(BandProgress, 3, []byte("hello")))
+	assert.Equal(t, "0008\x02hel0007\x02lo", buf.String())
+
+	buf.Reset()
+	w := NewSidebandWriter(buf, BandData, 0)
+	n, err := w.Write(make([]byte, MaxSidebandData+1))
+	require.NoError(t, err)
+	assert.Equal(t, MaxSidebandData+1, n)
+
+	scanner := NewScanner(buf)
+	require.True(t, scanner.Scan())
+	assert.Len(t, scanner.Bytes(), MaxPayloadSize)
+	require.True(t, scanner.Scan())
+	assert.Equal(t, []byte{BandData, 0}, scanner.Bytes())
+	assert.False(t, scanner.Scan())
+	assert.NoError(t, scanner.Err())
+}
+
+func TestScanner(t *testing.T) {
+	input := "000ahello\n" + "0000" + "0001" + "0002" + "0004" + "PACK"
+	r := strings.NewReader(input)
+	scanner := NewScanner(r)
+
+	require.True(t, scanner.Scan())
+	assert.Equal(t, Data, scanner.Type())
+	assert.Equal(t, "hello\n", scanner.Text())
+	assert.Equal(t, "000ahello\n", string(scanner.Raw()))
+
+	for _, typ := range []PacketType{Flush, Delim, ResponseEnd} {
+		require.True(t, scanner.Scan())
+		assert.Equal(t, typ, scanner.Type())
+		assert.Nil(t, scanner.Bytes())
+	}
+
+	require.True(t, scanner.Scan())
+	assert.Equal(t, Data, scanner.Type())
+	assert.Empty(t, scanner.Bytes())
+
+	// Scanner does not read past the packet
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "PACK", string(rest))
+}
+
+func TestScanner_Errors(t *testing.T) {
+	examples := map[string]error{
+		"0003":      ErrInvalidLength,
+		"zzzz":      ErrInvalidLength,
+		"+00a":      ErrInvalidLength,
+		"fff1":      ErrInvalidLength,
+		"000ahel":   io.ErrUnexpectedEOF,
+		"00":        io.ErrUnexpectedEOF,
+		"0000000ab": io.ErrUnexpectedEOF,
+	}
+
+	for input, expected := range examples {
+		scanner := NewScanner(strings.NewReader(input))
+		for scanner.Scan() {
+		}
+		assert.True(t, errors.Is(scanner.Err(), expected), input)
+		assert.False(t, scanner.Scan())
+	}
+
+	scanner := NewScanner(strings.NewReader(""))
+	assert.False(t, scanner.Scan())
+	assert.NoError(t, scanner.Err())
+}
+
+func TestErrorMessage(t *testing.T) {
+	message, ok := ErrorMessage([]byte("ERR access denied\n"))
+	assert.True(t, ok)
+	assert.Equal(t, "access denied", message)
+
+	_, ok = ErrorMessage([]byte("ok refs/heads/master\n"))
+	assert.False(t, ok)
+}
+
+func TestSplitSideband(t *testing.T) {
+	band, data, err := SplitSideband([]byte("\x02progress"))
+	assert.NoError(t, err)
+	assert.Equal(t, BandProgress, band)
+	assert.Equal(t, "progress", string(data))
+
+	_, _, err = SplitSideband([]byte("\x04data"))
+	assert.Equal(t, ErrInvalidBand, err)
+
+	_, _, err = SplitSideband(nil)
+	assert.Equal(t, ErrInvalidBand, err)
+}
+
+func FuzzScanner(f *testing.F) {
+	f.Add([]byte("000ahello\n0000"))
+	f.Add([]byte("00010002000400"))
+	f.Add([]byte("fff0"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		out := bytes.NewBuffer(nil)
+		enc := NewEncoder(out)
+		packets := []string{}
+
+		scanner := NewScanner(bytes.NewReader(input))
+		for scanner.Scan() {
+			if scanner.Type() == Data {
+				require.NoError(t, enc.Encode(scanner.Bytes()))
+			} else {
+				require.NoError(t, enc.special(scanner.Type()))
+			}
+			packets = append(packets, fmt.Sprintf("%d:%q", scanner.Type(), scanner.Bytes()))
+		}
+
+		// Encoded packets are read back the same way
+		scanner = NewScanner(out)
+		for _, packet := range packets {
+			require.True(t, scanner.Scan())
+			assert.Equal(t, packet, fmt.Sprintf("%d:%q", scanner.Type(), scanner.Bytes()))
+		}
+		assert.False(t, scanner.Scan())
+		assert.NoError(t, scanner.Err())
+	})
+}
+
+func FuzzEncoder(f *testing.F) {
+	f.Add([]byte("hello\n"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		buf := bytes.NewBuffer(nil)
+		err := NewEncoder(buf).Encode(payload)
+		if len(payload) > MaxPayloadSize {
+			assert.Equal(t, ErrPayloadTooLarge, err)
+			return
+		}
+		require.NoError(t, err)
+
+		scanner := NewScanner(buf)
+		require.True(t, scanner.Scan())
+		assert.Equal(t, Data, scanner.Type())
+		assert.Equal(t, payload, append([]byte{}, scanner.Bytes()...))
+		assert.False(t, scanner.Scan())
+	})
+}
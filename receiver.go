@@ -16,6 +16,7 @@ const ZeroSHA = "0000000000000000000000000000000000000000"
 type Receiver struct {
 	Debug       bool
 	MasterOnly  bool
+	LFSLocks    bool
 	TmpDir      string
 	HandlerFunc func(*HookInfo, string) error
 }
@@ -34,8 +35,21 @@ func IsForcePush(hook *HookInfo) (bool, error) {
 		return false, nil
 	}
 
-	out, err := exec.Command("git", "merge-base", hook.OldRev, hook.NewRev).CombinedOutput()
+	env, err := hook.GitEnv()
 	if err != nil {
+		return false, err
+	}
+
+	cmd := exec.Command("git", "merge-base", hook.OldRev, hook.NewRev)
+	cmd.Dir = hook.RepoPath
+	cmd.Env = append(os.Environ(), env...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// Histories without a common ancestor could only be replaced by force
+		if exitCode(err) == 1 && len(out) == 0 {
+			return true, nil
+		}
 		return false, fmt.Errorf("git merge base failed: %s", out)
 	}
 
@@ -45,14 +59,43 @@ func IsForcePush(hook *HookInfo) (bool, error) {
 	return base != hook.OldRev, nil
 }
 
+// Handle runs the handler for every ref update of the hook input. Checks of
+// all updates are done before the handler is called for the first one.
 func (r *Receiver) Handle(reader io.Reader) error {
-	hook, err := ReadHookInput(reader)
+	hooks, err := ReadHookInputs(reader)
 	if err != nil {
 		return err
 	}
 
-	if r.MasterOnly && hook.Ref != "refs/heads/master" {
-		return fmt.Errorf("cant push to non-master branch")
+	for _, hook := range hooks {
+		if r.MasterOnly && hook.Ref != "refs/heads/master" {
+			return fmt.Errorf("cant push to non-master branch")
+		}
+
+		if r.LFSLocks {
+			if err := CheckLFSLocks(hook, hook.User); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, hook := range hooks {
+		if err := r.handle(hook); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handle checks out the new revision and runs the handler. Deleted refs have
+// nothing to check out, so the handler gets an empty path.
+func (r *Receiver) handle(hook *HookInfo) error {
+	if hook.NewRev == ZeroSHA {
+		if r.HandlerFunc != nil {
+			return r.HandlerFunc(hook, "")
+		}
+		return nil
 	}
 
 	id, err := uuid.NewV4()
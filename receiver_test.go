@@ -0,0 +1,46 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiverHandle(t *testing.T) {
+	work := newWorkTree(t)
+	head := strings.TrimSpace(mustGit(t, work, "rev-parse", "HEAD"))
+
+	// Hooks run in the repository directory
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(work))
+	defer os.Chdir(cwd)
+
+	handled := map[string]string{}
+	receiver := Receiver{
+		TmpDir: t.TempDir(),
+		HandlerFunc: func(hook *HookInfo, tmpPath string) error {
+			handled[hook.RefName] = tmpPath
+			if tmpPath != "" {
+				assert.FileExists(t, filepath.Join(tmpPath, "README"))
+			}
+			return nil
+		},
+	}
+
+	input := ZeroSHA + " " + head + " refs/heads/feature/x\n" + head + " " + ZeroSHA + " refs/tags/v1\n"
+	require.NoError(t, receiver.Handle(strings.NewReader(input)))
+	require.Len(t, handled, 2)
+	assert.NotEmpty(t, handled["feature/x"])
+	assert.Equal(t, "", handled["v1"])
+
+	receiver.MasterOnly = true
+	handled = map[string]string{}
+	input = ZeroSHA + " " + head + " refs/heads/master\n" + ZeroSHA + " " + head + " refs/heads/dev\n"
+	assert.EqualError(t, receiver.Handle(strings.NewReader(input)), "cant push to non-master branch")
+	assert.Empty(t, handled)
+}
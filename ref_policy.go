@@ -0,0 +1,356 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sosedoff/gitkit/pktline"
+)
+
+// RefPolicy checks a single ref update before the push is passed to receive-pack.
+// Returned error rejects the whole push, its message is reported to the client.
+type RefPolicy func(hook *HookInfo) error
+
+// DenyForcePush returns a policy that rejects non fast-forward updates of the
+// given refs, or of all refs if none are given.
+func DenyForcePush(refs ...string) RefPolicy {
+	return func(hook *HookInfo) error {
+		if len(refs) > 0 && !stringInSlice(hook.Ref, refs) {
+			return nil
+		}
+
+		force, err := IsForcePush(hook)
+		if err != nil {
+			return err
+		}
+		if force {
+			return fmt.Errorf("force push is not allowed")
+		}
+		return nil
+	}
+}
+
+// refUpdate is a single command of receive-pack request
+type refUpdate struct {
+	oldRev string
+	newRev string
+	ref    string
+}
+
+// receivePackRequest holds the command list sent by a client to receive-pack
+type receivePackRequest struct {
+	updates []refUpdate
+	caps    []string
+	raw     bytes.Buffer // Commands and push options as sent by the client
+}
+
+// readReceivePackRequest reads receive-pack commands and push options, leaving
+// the pack data in the reader.
+func readReceivePackRequest(r io.Reader) (*receivePackRequest, error) {
+	req := &receivePackRequest{}
+	scanner := pktline.NewScanner(r)
+
+	for {
+		if !scanner.Scan() {
+			return nil, scannerError(scanner)
+		}
+		req.raw.Write(scanner.Raw())
+
+		if scanner.Type() == pktline.Flush {
+			break
+		}
+
+		line := strings.TrimSuffix(scanner.Text(), "\n")
+		if strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+		if strings.HasPrefix(line, "push-cert") {
+			return nil, fmt.Errorf("signed pushes are not supported")
+		}
+
+		// Capabilities are sent after the first command
+		if len(req.updates) == 0 {
+			if idx := strings.IndexByte(line, 0); idx >= 0 {
+				req.caps = strings.Fields(line[idx+1:])
+				line = line[:idx]
+			}
+		}
+
+		chunks := strings.Split(line, " ")
+		if len(chunks) != 3 {
+			return nil, fmt.Errorf("invalid receive-pack command: %q", line)
+		}
+		req.updates = append(req.updates, refUpdate{oldRev: chunks[0], newRev: chunks[1], ref: chunks[2]})
+	}
+
+	// Push options are terminated with another flush packet
+	if len(req.updates) > 0 && stringInSlice("push-options", req.caps) {
+		for {
+			if !scanner.Scan() {
+				return nil, scannerError(scanner)
+			}
+			req.raw.Write(scanner.Raw())
+
+			if scanner.Type() == pktline.Flush {
+				break
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// scannerError returns scanner error, treating the end of input as unexpected
+func scannerError(scanner *pktline.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// needsPack returns true if the client is going to send pack data
+func (req *receivePackRequest) needsPack() bool {
+	for _, update := range req.updates {
+		if update.newRev != ZeroSHA {
+			return true
+		}
+	}
+	return false
+}
+
+// report returns report-status response with a rejection reason for each
+// update, empty reason means the update was accepted.
+func (req *receivePackRequest) report(unpack string, reasons []string) []byte {
+	status := bytes.NewBuffer(nil)
+	if !stringInSlice("report-status", req.caps) && !stringInSlice("report-status-v2", req.caps) {
+		return status.Bytes()
+	}
+
+	enc := pktline.NewEncoder(status)
+	enc.EncodeString("unpack " + unpack + "\n")
+	for i, update := range req.updates {
+		if reasons[i] == "" {
+			enc.EncodeString("ok " + update.ref + "\n")
+		} else {
+			enc.EncodeString("ng " + update.ref + " " + reasons[i] + "\n")
+		}
+	}
+	enc.Flush()
+
+	size := 0
+	if stringInSlice("side-band-64k", req.caps) {
+		size = pktline.MaxSidebandData
+	} else if stringInSlice("side-band", req.caps) {
+		size = pktline.SmallSidebandData
+	}
+	if size == 0 {
+		return status.Bytes()
+	}
+
+	// Report is sent over the primary data band
+	out := bytes.NewBuffer(nil)
+	enc = pktline.NewEncoder(out)
+	enc.Sideband(pktline.BandData, size, status.Bytes())
+	enc.Flush()
+
+	return out.Bytes()
+}
+
+// quarantine holds objects pushed by a client until the push is accepted. Pack
+// data is only received and indexed when a policy needs to look at objects.
+type quarantine struct {
+	gitPath string
+	repoDir string
+	input   io.Reader // Pack data sent by the client, nil for delete only pushes
+	dir     string
+	pack    *os.File
+	done    bool
+	err     error
+}
+
+func newQuarantine(gitPath string, repoPath string, input io.Reader) (*quarantine, error) {
+	repoDir, err := filepath.Abs(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return &quarantine{gitPath: gitPath, repoDir: repoDir, input: input}, nil
+}
+
+// env receives pushed objects on first call and returns environment for git
+// commands to see them
+func (q *quarantine) env() ([]string, error) {
+	if q.input == nil {
+		return nil, nil
+	}
+
+	if !q.done {
+		q.done = true
+		q.err = q.receive()
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	return q.objectsEnv(), nil
+}
+
+func (q *quarantine) objectsEnv() []string {
+	return []string{
+		"GIT_DIR=" + q.repoDir,
+		"GIT_QUARANTINE_PATH=" + q.dir,
+		"GIT_OBJECT_DIRECTORY=" + q.dir,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + filepath.Join(q.repoDir, "objects"),
+	}
+}
+
+// receive stores pack data for replay and indexes it into quarantine objects.
+// Like receive-pack, it keeps quarantine inside of the repository objects.
+func (q *quarantine) receive() error {
+	dir, err := ioutil.TempDir(filepath.Join(q.repoDir, "objects"), "incoming-gitkit-")
+	if err != nil {
+		return err
+	}
+	q.dir = dir
+
+	if err := os.MkdirAll(filepath.Join(dir, "pack"), 0755); err != nil {
+		return err
+	}
+
+	pack, err := os.Create(filepath.Join(dir, "incoming.pack"))
+	if err != nil {
+		return err
+	}
+	q.pack = pack
+
+	if _, err := io.Copy(pack, q.input); err != nil {
+		return err
+	}
+	if _, err := pack.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(q.gitPath, "index-pack", "--stdin", "--fix-thin")
+	cmd.Dir = q.repoDir
+	cmd.Env = append(os.Environ(), q.objectsEnv()...)
+	cmd.Stdin = pack
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("index-pack failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	_, err = pack.Seek(0, io.SeekStart)
+	return err
+}
+
+func (q *quarantine) cleanup() {
+	if q.pack != nil {
+		q.pack.Close()
+	}
+	if q.dir != "" {
+		os.RemoveAll(q.dir)
+	}
+}
+
+// replayReader replays the receive-pack request and removes quarantine on close
+type replayReader struct {
+	io.Reader
+	q *quarantine
+}
+
+func (r *replayReader) Close() error {
+	if r.q != nil {
+		r.q.cleanup()
+	}
+	return nil
+}
+
+// enforceRefPolicies reads receive-pack commands from input and runs ref
+// policies for each update. Pack data is only read ahead if a policy needs
+// pushed objects. Session is the environment from sessionEnv, it fills pusher
+// details of the hook info. It returns a reader that replays the whole request
+// to receive-pack, or a nil reader and report-status response for the client
+// when the push is rejected.
+func enforceRefPolicies(config *Config, session []string, repoName string, repoPath string, input io.Reader) (io.ReadCloser, []byte, error) {
+	br := bufio.NewReader(input)
+
+	req, err := readReceivePackRequest(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(req.updates) == 0 {
+		return &replayReader{Reader: io.MultiReader(&req.raw, br)}, nil, nil
+	}
+
+	var pack io.Reader
+	if req.needsPack() {
+		pack = br
+	}
+
+	q, err := newQuarantine(config.GitPath, repoPath, pack)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reasons := make([]string, len(req.updates))
+	rejected := false
+
+	for i, update := range req.updates {
+		hook := newHookInfo(repoName, repoPath, update.oldRev, update.newRev, update.ref)
+		hook.readEnv(envLookup(session))
+		hook.env = q.env
+
+		for _, policy := range config.RefPolicies {
+			if err := policy(hook); err != nil {
+				reasons[i] = sanitizeReason(err.Error())
+				rejected = true
+				break
+			}
+		}
+
+		if q.err != nil {
+			break
+		}
+	}
+
+	if q.err != nil {
+		q.cleanup()
+		for i := range reasons {
+			reasons[i] = "unpacker error"
+		}
+		return nil, req.report(sanitizeReason(q.err.Error()), reasons), nil
+	}
+
+	if rejected {
+		// Client expects the report after all pack data is sent
+		if q.input != nil && !q.done {
+			io.Copy(ioutil.Discard, q.input)
+		}
+		q.cleanup()
+
+		// Push is rejected as a whole, so other refs are not updated either
+		for i := range reasons {
+			if reasons[i] == "" {
+				reasons[i] = "atomic push failed"
+			}
+		}
+		return nil, req.report("ok", reasons), nil
+	}
+
+	replay := io.MultiReader(&req.raw, br)
+	if q.pack != nil {
+		replay = io.MultiReader(&req.raw, q.pack, br)
+	}
+	return &replayReader{Reader: replay, q: q}, nil, nil
+}
+
+// sanitizeReason makes error message fit into a single report-status line
+func sanitizeReason(reason string) string {
+	return strings.Join(strings.Fields(reason), " ")
+}
@@ -0,0 +1,245 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOldRev = "e285100b636ac67fa28d85685072158edaa01685"
+	testNewRev = "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"
+)
+
+func Test_readReceivePackRequest(t *testing.T) {
+	body := bytes.NewBuffer(nil)
+	packLine(body, "shallow "+testOldRev+"\n")
+	packLine(body, testOldRev+" "+testNewRev+" refs/heads/master\x00report-status side-band-64k push-options\n")
+	packLine(body, ZeroSHA+" "+testNewRev+" refs/tags/v1\n")
+	packFlush(body)
+	packLine(body, "ci.skip\n")
+	packFlush(body)
+	body.WriteString("PACK")
+
+	input := bytes.NewReader(body.Bytes())
+	req, err := readReceivePackRequest(input)
+	require.NoError(t, err)
+
+	assert.Equal(t, []refUpdate{
+		{oldRev: testOldRev, newRev: testNewRev, ref: "refs/heads/master"},
+		{oldRev: ZeroSHA, newRev: testNewRev, ref: "refs/tags/v1"},
+	}, req.updates)
+	assert.Equal(t, []string{"report-status", "side-band-64k", "push-options"}, req.caps)
+	assert.True(t, req.needsPack())
+
+	// Everything before pack data is kept for replay
+	assert.Equal(t, body.Len()-4, req.raw.Len())
+	assert.Equal(t, 4, input.Len())
+
+	_, err = readReceivePackRequest(strings.NewReader("0010invalid line0000"))
+	assert.Error(t, err)
+}
+
+func Test_receivePackRequest_report(t *testing.T) {
+	req := &receivePackRequest{
+		updates: []refUpdate{{ref: "refs/heads/master"}, {ref: "refs/heads/dev"}},
+		caps:    []string{"report-status"},
+	}
+
+	report := req.report("ok", []string{"", "not allowed"})
+	assert.Equal(t, "000eunpack ok\n0019ok refs/heads/master\n0022ng refs/heads/dev not allowed\n0000", string(report))
+
+	req.caps = append(req.caps, "side-band-64k")
+	report = req.report("ok", []string{"", "not allowed"})
+	assert.Equal(t, "0052\x01000eunpack ok\n0019ok refs/heads/master\n0022ng refs/heads/dev not allowed\n00000000", string(report))
+
+	req.caps = nil
+	assert.Empty(t, req.report("ok", []string{"", ""}))
+}
+
+func TestRefPoliciesHTTP(t *testing.T) {
+	hooks := []HookInfo{}
+	policies := []RefPolicy{
+		func(hook *HookInfo) error {
+			hooks = append(hooks, *hook)
+			return nil
+		},
+		DenyForcePush("refs/heads/master"),
+	}
+
+	server, ts := newTestServer(t, Config{AutoCreate: true, RefPolicies: policies})
+	url := ts.URL + "/test.git"
+	repoPath := filepath.Join(server.config.Dir, "test.git")
+
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+	require.Len(t, hooks, 1)
+	assert.Equal(t, "branch.create", hooks[0].Action)
+	assert.Equal(t, "test.git", hooks[0].RepoName)
+
+	// Fast-forward updates are allowed
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit")
+	mustGit(t, work, "push", url, "master")
+	head := mustGit(t, repoPath, "rev-parse", "master")
+
+	// Rewritten history is rejected along with other refs in the push
+	mustGit(t, work, "commit", "--amend", "--allow-empty", "-m", "Amended commit")
+	mustGit(t, work, "tag", "v1")
+	_, stderr, err := runGit(t, work, nil, "push", "--force", url, "master", "v1")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> master (force push is not allowed)")
+	assert.Contains(t, stderr, "! [remote rejected] v1 -> v1 (atomic push failed)")
+
+	assert.Equal(t, head, mustGit(t, repoPath, "rev-parse", "master"))
+	_, _, err = runGit(t, repoPath, nil, "rev-parse", "--verify", "refs/tags/v1")
+	assert.Error(t, err)
+
+	// Other branches could be force pushed
+	mustGit(t, work, "push", url, "master:dev")
+	mustGit(t, work, "commit", "--amend", "--allow-empty", "-m", "Amended again")
+	mustGit(t, work, "push", "--force", url, "master:dev")
+}
+
+func TestRefPoliciesSSH(t *testing.T) {
+	denyTagDelete := func(hook *HookInfo) error {
+		if hook.Action == TagDeleteAction {
+			return fmt.Errorf("tags could not be deleted")
+		}
+		return nil
+	}
+
+	_, port := newTestSSH(t, Config{AutoCreate: true, RefPolicies: []RefPolicy{DenyForcePush(), denyTagDelete}})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	mustGit(t, work, "tag", "v1")
+	_, stderr, err := runGit(t, work, env, "push", url, "master", "v1")
+	require.NoError(t, err, stderr)
+
+	mustGit(t, work, "commit", "--amend", "--allow-empty", "-m", "Amended commit")
+	_, stderr, err = runGit(t, work, env, "push", "--force", url, "master")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> master (force push is not allowed)")
+	assert.NotContains(t, stderr, "fatal")
+
+	// Delete only pushes do not send pack data
+	_, stderr, err = runGit(t, work, env, "push", url, ":v1")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] v1 (tags could not be deleted)")
+}
+
+func TestRefPoliciesSSHInvalidRequest(t *testing.T) {
+	_, port := newTestSSH(t, Config{AutoCreate: true, RefPolicies: []RefPolicy{DenyForcePush()}})
+
+	args := strings.Fields(strings.TrimPrefix(sshCommand(port), "GIT_SSH_COMMAND="))
+	cmd := exec.Command(args[0], append(args[1:], "git@127.0.0.1", "git-receive-pack 'test.git'")...)
+	cmd.Stdin = strings.NewReader("0010invalid line0000")
+
+	// Client gets an error instead of a dropped connection
+	out, err := cmd.Output()
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "ERR internal server error")
+}
+
+func TestRefPoliciesPusher(t *testing.T) {
+	var mu sync.Mutex
+	hooks := []HookInfo{}
+	record := func(hook *HookInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		hooks = append(hooks, *hook)
+		return nil
+	}
+
+	_, ts := newTestServer(t, Config{AutoCreate: true, Auth: true, RefPolicies: []RefPolicy{record}}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			return cred.Username == "alice", nil
+		}
+	})
+
+	work := newWorkTree(t)
+	url := strings.Replace(ts.URL, "http://", "http://alice:secret@", 1) + "/test.git"
+	_, stderr, err := runGit(t, work, nil, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).Run())
+
+	_, port := newTestSSH(t, Config{AutoCreate: true, Auth: true, RefPolicies: []RefPolicy{record}}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+			return &PublicKey{Id: "12345", Username: "bob"}, nil
+		}
+	})
+
+	env := []string{sshCommand(port) + " -i " + keyPath + " -o IdentitiesOnly=yes"}
+	_, stderr, err = runGit(t, work, env, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master")
+	require.NoError(t, err, stderr)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, hooks, 2)
+
+	assert.Equal(t, "alice", hooks[0].User)
+	assert.Empty(t, hooks[0].KeyID)
+	assert.Equal(t, "127.0.0.1", hooks[0].RemoteAddr)
+	assert.NotEmpty(t, hooks[0].RequestID)
+
+	assert.Equal(t, "bob", hooks[1].User)
+	assert.Equal(t, "12345", hooks[1].KeyID)
+	assert.Equal(t, "127.0.0.1", hooks[1].RemoteAddr)
+	assert.Equal(t, "test.git", hooks[1].RepoName)
+}
+
+func TestRefPoliciesQuarantine(t *testing.T) {
+	quarantines := map[string][]string{}
+	inspect := func(hook *HookInfo) error {
+		if hook.RefName == "objects" {
+			if _, err := hook.GitEnv(); err != nil {
+				return err
+			}
+		}
+		quarantines[hook.RefName], _ = filepath.Glob(filepath.Join(hook.RepoPath, "objects", "incoming-gitkit-*"))
+
+		if hook.RefName == "denied" {
+			return fmt.Errorf("branch is not allowed")
+		}
+		return nil
+	}
+
+	server, ts := newTestServer(t, Config{AutoCreate: true, RefPolicies: []RefPolicy{inspect}})
+	url := ts.URL + "/test.git"
+	repoPath := filepath.Join(server.config.Dir, "test.git")
+
+	// Pushed objects are received only if a policy asks for them
+	work := newWorkTree(t)
+	mustGit(t, work, "push", url, "master")
+	assert.Empty(t, quarantines["master"])
+
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit")
+	mustGit(t, work, "push", url, "master:objects")
+	assert.Len(t, quarantines["objects"], 1)
+	assert.NoDirExists(t, quarantines["objects"][0])
+	mustGit(t, repoPath, "cat-file", "-e", "objects")
+
+	// Client gets the report when pack data is not read by policies
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Third commit")
+	_, stderr, err := runGit(t, work, nil, "push", url, "master:denied")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> denied (branch is not allowed)")
+	assert.Empty(t, quarantines["denied"])
+
+	_, port := newTestSSH(t, Config{AutoCreate: true, RefPolicies: []RefPolicy{inspect}})
+	env := []string{sshCommand(port)}
+	_, stderr, err = runGit(t, work, env, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master:denied")
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "! [remote rejected] master -> denied (branch is not allowed)")
+	assert.NotContains(t, stderr, "fatal")
+}
@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidRepoName is returned for repository names rejected by the policy
+var ErrInvalidRepoName = errors.New("invalid repository name")
+
+var reRepoSegment = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// RepoNamePolicy restricts repository names accepted by HTTP and SSH servers.
+// Names with empty, relative or hidden path segments are always rejected.
+type RepoNamePolicy struct {
+	Pattern          *regexp.Regexp // Pattern for each path segment, defaults to letters, digits, dots, dashes and underscores
+	MaxDepth         int            // Maximum number of path segments, including namespaces. Zero means no limit.
+	RequireGitSuffix bool           // Require names to end with .git
+	Reserved         []string       // Names that could not be used for repositories or namespaces
+}
+
+// Validate returns an error if the repository name is not allowed. Name is
+// expected to be relative to the repositories directory, for example "org/repo.git".
+func (p RepoNamePolicy) Validate(name string) error {
+	if err := validateRepoPath(name); err != nil {
+		return err
+	}
+
+	pattern := p.Pattern
+	if pattern == nil {
+		pattern = reRepoSegment
+	}
+
+	segments := strings.Split(name, "/")
+	if p.MaxDepth > 0 && len(segments) > p.MaxDepth {
+		return fmt.Errorf("%w: more than %d path segments", ErrInvalidRepoName, p.MaxDepth)
+	}
+
+	for _, segment := range segments {
+		if !pattern.MatchString(segment) {
+			return fmt.Errorf("%w: %q contains disallowed characters", ErrInvalidRepoName, segment)
+		}
+
+		for _, reserved := range p.Reserved {
+			if strings.EqualFold(strings.TrimSuffix(segment, ".git"), reserved) {
+				return fmt.Errorf("%w: %q is reserved", ErrInvalidRepoName, segment)
+			}
+		}
+	}
+
+	if p.RequireGitSuffix && !strings.HasSuffix(name, ".git") {
+		return fmt.Errorf("%w: .git suffix is required", ErrInvalidRepoName)
+	}
+
+	return nil
+}
+
+// validateRepoPath rejects names that could point outside of the repositories
+// directory or into hidden directories.
+func validateRepoPath(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name is empty", ErrInvalidRepoName)
+	}
+
+	if strings.HasPrefix(name, "/") {
+		return fmt.Errorf("%w: absolute paths are not allowed", ErrInvalidRepoName)
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return fmt.Errorf("%w: contains disallowed characters", ErrInvalidRepoName)
+		}
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" {
+			return fmt.Errorf("%w: empty path segment", ErrInvalidRepoName)
+		}
+
+		// Covers "." and ".." segments as well
+		if strings.HasPrefix(segment, ".") {
+			return fmt.Errorf("%w: hidden or relative path segment %q", ErrInvalidRepoName, segment)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepoNamePolicy_Validate(t *testing.T) {
+	policy := RepoNamePolicy{}
+
+	valid := []string{"repo", "repo.git", "org/repo.git", "org/team/my_repo-1.git"}
+	for _, name := range valid {
+		assert.NoError(t, policy.Validate(name), name)
+	}
+
+	invalid := []string{
+		"",
+		"/etc/repo.git",
+		"../repo.git",
+		"org/../../repo.git",
+		"org/./repo.git",
+		".hidden.git",
+		"org/.ssh",
+		"org//repo.git",
+		"org\\repo.git",
+		"repo\x00.git",
+		"my repo.git",
+		"repo;rm.git",
+	}
+	for _, name := range invalid {
+		err := policy.Validate(name)
+		assert.Error(t, err, name)
+		assert.True(t, errors.Is(err, ErrInvalidRepoName), name)
+	}
+}
+
+func TestRepoNamePolicy_Options(t *testing.T) {
+	policy := RepoNamePolicy{
+		Pattern:          regexp.MustCompile(`^[a-z.]+$`),
+		MaxDepth:         2,
+		RequireGitSuffix: true,
+		Reserved:         []string{"admin"},
+	}
+
+	assert.NoError(t, policy.Validate("org/repo.git"))
+	assert.EqualError(t, policy.Validate("org/Repo.git"), `invalid repository name: "Repo.git" contains disallowed characters`)
+	assert.EqualError(t, policy.Validate("a/b/repo.git"), "invalid repository name: more than 2 path segments")
+	assert.EqualError(t, policy.Validate("org/repo"), "invalid repository name: .git suffix is required")
+	assert.EqualError(t, policy.Validate("admin.git"), `invalid repository name: "admin.git" is reserved`)
+	assert.EqualError(t, policy.Validate("admin/repo.git"), `invalid repository name: "admin" is reserved`)
+
+	// Baseline rules can't be relaxed with a pattern
+	policy.Pattern = regexp.MustCompile(`.*`)
+	assert.Error(t, policy.Validate("../repo.git"))
+}
+
+func TestRepoNameTraversalHTTP(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "repos")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	_, ts := newTestServer(t, Config{Dir: dir, AutoCreate: true})
+
+	paths := []string{
+		"/../outside.git/info/refs?service=git-upload-pack",
+		"/%2e%2e/outside.git/info/refs?service=git-upload-pack",
+		"/org/..%2f..%2foutside.git/info/refs?service=git-upload-pack",
+		"/.hidden.git/info/refs?service=git-upload-pack",
+	}
+
+	for _, p := range paths {
+		req, err := http.NewRequest("GET", ts.URL+p, nil)
+		require.NoError(t, err)
+		req.URL.Opaque = strings.SplitN(p, "?", 2)[0]
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, p)
+	}
+
+	assert.NoDirExists(t, filepath.Join(root, "outside.git"))
+	assert.NoDirExists(t, filepath.Join(dir, ".hidden.git"))
+}
+
+func TestRepoNameTraversalSSH(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "repos")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	_, port := newTestSSH(t, Config{Dir: dir, AutoCreate: true})
+
+	commands := []string{
+		"git-upload-pack '../outside.git'",
+		"git-upload-pack '/org/../../outside.git'",
+		"git upload-pack '.hidden.git'",
+	}
+
+	for _, command := range commands {
+		args := strings.Fields(strings.TrimPrefix(sshCommand(port), "GIT_SSH_COMMAND="))
+		args = append(args[1:], "git@127.0.0.1", command)
+
+		out, err := exec.Command("ssh", args...).CombinedOutput()
+		assert.Error(t, err, command)
+		assert.Contains(t, string(out), "Invalid command.", command)
+	}
+
+	assert.NoDirExists(t, filepath.Join(root, "outside.git"))
+	assert.NoDirExists(t, filepath.Join(dir, ".hidden.git"))
+
+	_, err := ParseGitCommand(fmt.Sprintf("git-receive-pack '%s'", "../outside.git"))
+	assert.Error(t, err)
+}
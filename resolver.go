@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxRepoRedirects limits how many redirects are followed to resolve a repository
+const maxRepoRedirects = 5
+
+// ErrRepoNotFound is returned by resolvers for repositories that do not exist
+// and must not be created automatically.
+var ErrRepoNotFound = errors.New("repository not found")
+
+// RepoRedirect is returned by resolvers when a repository has moved to a new name
+type RepoRedirect struct {
+	Name string // New repository name
+}
+
+func (e *RepoRedirect) Error() string {
+	return fmt.Sprintf("repository moved to %s", e.Name)
+}
+
+// RepoResolver maps a repository name requested by clients to its path on disk.
+// Returned path does not have to exist yet when AutoCreate is enabled.
+type RepoResolver interface {
+	Resolve(name string) (string, error)
+}
+
+// RepoResolverFunc is an adapter to use ordinary functions as RepoResolver
+type RepoResolverFunc func(name string) (string, error)
+
+// Resolve calls f(name)
+func (f RepoResolverFunc) Resolve(name string) (string, error) {
+	return f(name)
+}
+
+// RepoLister is implemented by resolvers that could enumerate repositories they
+// store. Admin API needs it to list repositories.
+type RepoLister interface {
+	List() ([]string, error)
+}
+
+// DirResolver stores repositories in a single base directory
+type DirResolver struct {
+	Dir string
+}
+
+// Resolve returns name joined with the base directory
+func (d DirResolver) Resolve(name string) (string, error) {
+	return filepath.Join(d.Dir, name), nil
+}
+
+// List returns names of repositories in the base directory. Directories starting
+// with a dot are skipped, repositories are not looked for inside of other ones.
+func (d DirResolver) List() ([]string, error) {
+	names := []string{}
+
+	err := filepath.Walk(d.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == d.Dir {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !repoExists(path) {
+			return nil
+		}
+
+		name, err := filepath.Rel(d.Dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+
+		return filepath.SkipDir
+	})
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+
+	return names, err
+}
+
+// resolveRepo returns final repository name and path, following redirects.
+// Redirect targets must be allowed by the name policy, like requested names.
+func resolveRepo(resolver RepoResolver, names RepoNamePolicy, name string) (string, string, error) {
+	for i := 0; i <= maxRepoRedirects; i++ {
+		repoPath, err := resolver.Resolve(name)
+		if err == nil {
+			return name, repoPath, nil
+		}
+
+		var redirect *RepoRedirect
+		if !errors.As(err, &redirect) {
+			return "", "", err
+		}
+		if err := names.Validate(redirect.Name); err != nil {
+			return "", "", err
+		}
+		name = redirect.Name
+	}
+
+	return "", "", fmt.Errorf("too many redirects for repository %s", name)
+}
@@ -0,0 +1,118 @@
+package gitkit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shardedResolver stores repositories in hash buckets and knows about renames
+func shardedResolver(dir string) RepoResolver {
+	return RepoResolverFunc(func(name string) (string, error) {
+		switch name {
+		case "old.git":
+			return "", &RepoRedirect{Name: "new.git"}
+		case "loop.git":
+			return "", &RepoRedirect{Name: "loop.git"}
+		case "missing.git":
+			return "", ErrRepoNotFound
+		}
+
+		sum := sha1.Sum([]byte(name))
+		return filepath.Join(dir, hex.EncodeToString(sum[:1]), name), nil
+	})
+}
+
+func Test_resolveRepo(t *testing.T) {
+	resolver := shardedResolver("/data")
+
+	name, repoPath, err := resolveRepo(resolver, RepoNamePolicy{}, "old.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "new.git", name)
+	assert.Equal(t, "/data/9f/new.git", repoPath)
+
+	_, _, err = resolveRepo(resolver, RepoNamePolicy{}, "loop.git")
+	assert.EqualError(t, err, "too many redirects for repository loop.git")
+
+	// Redirect targets follow the name policy
+	_, _, err = resolveRepo(resolver, RepoNamePolicy{Reserved: []string{"new"}}, "old.git")
+	assert.ErrorIs(t, err, ErrInvalidRepoName)
+
+	_, _, err = resolveRepo(resolver, RepoNamePolicy{}, "missing.git")
+	assert.Equal(t, ErrRepoNotFound, err)
+
+	name, repoPath, err = resolveRepo(DirResolver{Dir: "/data"}, RepoNamePolicy{}, "org/repo.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "org/repo.git", name)
+	assert.Equal(t, "/data/org/repo.git", repoPath)
+}
+
+func TestDirResolver_List(t *testing.T) {
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--bare", "repo.git")
+	mustGit(t, dir, "init", "--bare", "org/team/app.git")
+	mustGit(t, dir, "init", "--bare", ".trash/old.git")
+
+	names, err := DirResolver{Dir: dir}.List()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"repo.git", "org/team/app.git"}, names)
+
+	names, err = DirResolver{Dir: filepath.Join(dir, "missing")}.List()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestResolverHTTP(t *testing.T) {
+	dir := t.TempDir()
+	_, ts := newTestServer(t, Config{AutoCreate: true, Resolver: shardedResolver(dir)})
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, nil, "push", ts.URL+"/old.git", "master")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "redirecting to "+ts.URL+"/new.git/")
+	assert.DirExists(t, filepath.Join(dir, "9f", "new.git", "objects"))
+
+	dest := t.TempDir()
+	mustGit(t, dest, "clone", ts.URL+"/new.git", "clone")
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+
+	resp, err := http.Get(ts.URL + "/missing.git/info/refs?service=git-upload-pack")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestResolverHTTPPrefix(t *testing.T) {
+	dir := t.TempDir()
+	server, _ := newTestServer(t, Config{AutoCreate: true, Resolver: shardedResolver(dir)})
+	ts := httptest.NewServer(http.StripPrefix("/git", server))
+	t.Cleanup(ts.Close)
+
+	// Redirects keep the path prefix
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, nil, "push", ts.URL+"/git/old.git", "master")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "redirecting to "+ts.URL+"/git/new.git/")
+}
+
+func TestResolverSSH(t *testing.T) {
+	dir := t.TempDir()
+	_, port := newTestSSH(t, Config{AutoCreate: true, Resolver: shardedResolver(dir)})
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/old.git", port), "master")
+	require.NoError(t, err, stderr)
+	assert.DirExists(t, filepath.Join(dir, "9f", "new.git", "objects"))
+
+	_, stderr, err = runGit(t, work, env, "ls-remote", fmt.Sprintf("ssh://git@127.0.0.1:%s/missing.git", port))
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "repository not found")
+}
@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// ErrServerClosed is returned for requests that arrive during shutdown
+var ErrServerClosed = errors.New("server is shutting down, try again later")
+
+// tracker keeps account of requests, git processes and connections that are
+// active on a server, so it could be shut down without breaking them.
+type tracker struct {
+	mu        sync.Mutex
+	closing   bool
+	active    sync.WaitGroup
+	processes map[*exec.Cmd]struct{}
+	conns     map[io.Closer]struct{}
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		processes: map[*exec.Cmd]struct{}{},
+		conns:     map[io.Closer]struct{}{},
+	}
+}
+
+// begin registers a unit of work. Returned function must be called once the
+// work is done, false is returned if the server is shutting down.
+func (t *tracker) begin() (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closing {
+		return nil, false
+	}
+
+	t.active.Add(1)
+	once := sync.Once{}
+	return func() { once.Do(t.active.Done) }, true
+}
+
+// isClosing returns true once shutdown has started
+func (t *tracker) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// close stops accepting new work
+func (t *tracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing = true
+}
+
+// addProcess registers a started git process, returned function removes it
+func (t *tracker) addProcess(cmd *exec.Cmd) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.processes[cmd] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.processes, cmd)
+	}
+}
+
+// addConn registers an open connection, returned function removes it
+func (t *tracker) addConn(conn io.Closer) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns[conn] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.conns, conn)
+	}
+}
+
+// shutdown stops new work and waits for active work to finish. Remaining git
+// process groups are killed and connections are closed when context is done.
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.close()
+
+	idle := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(idle)
+	}()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for cmd := range t.processes {
+		if cmd.Process != nil && cmd.Process.Pid > 0 {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,132 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSlowPushGit creates a git wrapper that delays receive-pack after recording its pid
+func newSlowPushGit(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "pid")
+	gitPath := filepath.Join(dir, "git")
+
+	script := "#!/bin/sh\ncase \"$*\" in\n*advertise-refs*) ;;\n*receive-pack*) echo $$ > " + pidFile + "; sleep 1 ;;\nesac\nexec git \"$@\"\n"
+	require.NoError(t, ioutil.WriteFile(gitPath, []byte(script), 0755))
+
+	return gitPath, pidFile
+}
+
+// waitFile waits for a file to be created
+func waitFile(t *testing.T, path string) {
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	gitPath, pidFile := newSlowPushGit(t)
+	server, ts := newTestServer(t, Config{GitPath: gitPath, AutoCreate: true})
+	url := ts.URL + "/test.git"
+
+	work := newWorkTree(t)
+	pushed := make(chan error)
+	go func() {
+		_, stderr, err := runGit(t, work, nil, "push", url, "master")
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, stderr)
+		}
+		pushed <- err
+	}()
+
+	waitFile(t, pidFile)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	require.NoError(t, <-pushed)
+
+	head := mustGit(t, work, "rev-parse", "master")
+	assert.Equal(t, head, mustGit(t, filepath.Join(server.config.Dir, "test.git"), "rev-parse", "master"))
+
+	resp, err := http.Get(url + "/info/refs?service=git-upload-pack")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	gitPath, pidFile := newSlowGit(t)
+	server, ts := newTestServer(t, Config{GitPath: gitPath})
+	require.NoError(t, os.MkdirAll(filepath.Join(server.config.Dir, "test.git", "objects"), 0755))
+
+	go func() {
+		resp, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}()
+
+	waitFile(t, pidFile)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.True(t, waitProcessExit(t, pidFile), "git process is still running")
+}
+
+func TestSSH_Shutdown(t *testing.T) {
+	gitPath, pidFile := newSlowPushGit(t)
+	server, port := newTestSSH(t, Config{GitPath: gitPath, AutoCreate: true})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	pushed := make(chan error)
+	go func() {
+		_, stderr, err := runGit(t, work, env, "push", url, "master")
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, stderr)
+		}
+		pushed <- err
+	}()
+
+	waitFile(t, pidFile)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	require.NoError(t, <-pushed)
+
+	_, _, err := runGit(t, work, env, "ls-remote", url)
+	assert.Error(t, err)
+}
+
+func TestSSH_ShutdownTimeout(t *testing.T) {
+	gitPath, pidFile := newSlowGit(t)
+	server, port := newTestSSH(t, Config{GitPath: gitPath})
+	require.NoError(t, os.MkdirAll(filepath.Join(server.config.Dir, "test.git", "objects"), 0755))
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+
+	fetched := make(chan error)
+	go func() {
+		_, _, err := runGit(t, t.TempDir(), []string{sshCommand(port)}, "ls-remote", url)
+		fetched <- err
+	}()
+
+	waitFile(t, pidFile)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.True(t, waitProcessExit(t, pidFile), "git process is still running")
+	assert.Error(t, <-fetched)
+}
@@ -1,7 +1,7 @@
 package gitkit
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -10,13 +10,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/sosedoff/gitkit/pktline"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -30,6 +31,7 @@ type PublicKey struct {
 	Name        string
 	Fingerprint string
 	Content     string
+	Username    string // Owner of the key, shared with HTTP identity for LFS locks and hooks
 }
 
 type SSH struct {
@@ -37,16 +39,26 @@ type SSH struct {
 
 	sshconfig           *ssh.ServerConfig
 	config              *Config
+	limiter             *limiter
+	hooks               *hookServer
+	tracker             *tracker
 	PublicKeyLookupFunc func(string) (*PublicKey, error)
+	Authorizer          Authorizer
+	Observer            Observer
 }
 
 func NewSSH(config Config) *SSH {
-	s := &SSH{config: &config}
+	s := &SSH{
+		config:  &config,
+		limiter: newLimiter(config.Limits),
+		tracker: newTracker(),
+	}
 
 	// Use PATH if full path is not specified
 	if s.config.GitPath == "" {
 		s.config.GitPath = "git"
 	}
+	s.hooks = newHookServer(s.config.HookCallbacks, s.config.GitPath, s.config.logger())
 	return s
 }
 
@@ -63,24 +75,77 @@ func cleanCommand(cmd string) string {
 	return cmd[i:]
 }
 
-func execCommandBytes(cmdname string, args ...string) ([]byte, []byte, error) {
-	bufOut := new(bytes.Buffer)
-	bufErr := new(bytes.Buffer)
+// acceptEnv checks whether the client is allowed to set an environment variable
+// for the git process and returns the value to use.
+func (s *SSH) acceptEnv(name string, value string) (string, bool) {
+	if name == "GIT_PROTOCOL" {
+		value = parseGitProtocol(value)
+		return value, value != ""
+	}
+
+	for _, allowed := range s.config.AllowedEnv {
+		if name == allowed {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// authorize checks whether the key is allowed to run the git command. It also
+// returns a message for the client: a notice for allowed requests or a reason
+// of rejection.
+func (s *SSH) authorize(identity Identity, gitcmd *GitCommand, log Logger) (bool, string) {
+	if s.Authorizer == nil {
+		return true, ""
+	}
+
+	allow, err := s.Authorizer.Authorize(identity, gitcmd.Repo, rpcService(gitcmd.Command))
+	message, hasMessage := clientMessage(err)
 
-	cmd := exec.Command(cmdname, args...)
-	cmd.Stdout = bufOut
-	cmd.Stderr = bufErr
+	if allow && isNotice(err) {
+		return true, message
+	}
+	if err != nil && !hasMessage {
+		log.Error("ssh: authorization failed", "error", err)
+		return false, ""
+	}
+	if !allow || err != nil {
+		log.Warn("ssh: access denied")
+		return false, message
+	}
+	return true, ""
+}
+
+// rejectExec sends an error message to the git client and fails the exec request
+func rejectExec(ch ssh.Channel, message string) {
+	pktline.NewEncoder(ch).Error(message)
+	ch.SendRequest("exit-status", false, exitStatus(1))
+}
 
-	err := cmd.Run()
-	return bufOut.Bytes(), bufErr.Bytes(), err
+// exitStatus returns payload for the exit-status channel request
+func exitStatus(code uint32) []byte {
+	return ssh.Marshal(struct{ Status uint32 }{code})
 }
 
-func execCommand(cmdname string, args ...string) (string, string, error) {
-	bufOut, bufErr, err := execCommandBytes(cmdname, args...)
-	return string(bufOut), string(bufErr), err
+// commandExitCode returns exit code of git process for the client. Processes
+// killed by signals have no exit code and are reported as failed.
+func commandExitCode(err error) uint32 {
+	code := exitCode(err)
+	if code < 0 {
+		return 1
+	}
+	return uint32(code)
 }
 
-func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
+func (s *SSH) handleConnection(conn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	identity := Identity{}
+	if conn.Permissions != nil {
+		identity.KeyID = conn.Permissions.Extensions["key-id"]
+		identity.Username = conn.Permissions.Extensions["username"]
+	}
+	log := withFields(s.config.logger(), "remote_addr", conn.RemoteAddr(), "key_id", identity.KeyID)
+
 	for newChan := range chans {
 		if newChan.ChannelType() != "session" {
 			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -89,42 +154,43 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
-			log.Printf("error accepting channel: %v", err)
+			log.Error("ssh: error accepting channel", "error", err)
 			continue
 		}
 
 		go func(in <-chan *ssh.Request) {
 			defer ch.Close()
 
+			// Environment variables accepted for the session
+			env := []string{}
+
 			for req := range in {
 				payload := cleanCommand(string(req.Payload))
 
 				switch req.Type {
 				case "env":
-					log.Printf("ssh: incoming env request: %s\n", payload)
-
-					args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
-					if len(args) != 2 {
-						log.Printf("env: invalid env arguments: '%#v'", args)
+					var envReq struct{ Name, Value string }
+					if err := ssh.Unmarshal(req.Payload, &envReq); err != nil {
+						log.Warn("ssh: invalid env request", "error", err)
+						req.Reply(false, nil)
 						continue
 					}
 
-					args[0] = strings.TrimLeft(args[0], "\x04")
-					if len(args[0]) == 0 {
-						log.Printf("env: invalid key from payload: %s", payload)
+					log.Debug("ssh: incoming env request", "name", envReq.Name)
+
+					value, ok := s.acceptEnv(envReq.Name, envReq.Value)
+					if !ok {
+						log.Warn("ssh: rejected env variable", "name", envReq.Name)
+						req.Reply(false, nil)
 						continue
 					}
 
-					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-					if err != nil {
-						log.Printf("env: %v", err)
-						return
-					}
+					env = append(env, envReq.Name+"="+value)
+					req.Reply(true, nil)
 				case "exec":
-					log.Printf("ssh: incoming exec request: %s\n", payload)
+					log.Info("ssh: incoming exec request", "command", payload)
 
 					cmdName := strings.TrimLeft(payload, "'()")
-					log.Printf("ssh: payload '%v'", cmdName)
 
 					if strings.HasPrefix(cmdName, "\x00") {
 						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
@@ -132,62 +198,198 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 					gitcmd, err := ParseGitCommand(cmdName)
 					if err != nil {
-						log.Println("ssh: error parsing command:", err)
-						ch.Write([]byte("Invalid command.\r\n"))
+						log.Warn("ssh: error parsing command", "error", err)
+						rejectExec(ch, "Invalid command.")
+						return
+					}
+
+					reqID := requestID("")
+					log := withFields(log, "repo", gitcmd.Repo, "service", subCommand(gitcmd.Command), "request_id", reqID)
+					start := time.Now()
+
+					done, ok := s.tracker.begin()
+					if !ok {
+						log.Warn("ssh: exec rejected", "error", ErrServerClosed)
+						rejectExec(ch, ErrServerClosed.Error())
+						return
+					}
+					defer done()
+
+					if err := s.config.RepoNames.Validate(gitcmd.Repo); err != nil {
+						log.Warn("ssh: repo name rejected", "error", err)
+						rejectExec(ch, err.Error())
+						return
+					}
+
+					// Redirects are followed in place, ssh has no way to tell the new location
+					repoName, repoPath, err := resolveRepo(s.config.resolver(), s.config.RepoNames, gitcmd.Repo)
+					if err != nil {
+						log.Warn("ssh: cant resolve repo", "error", err)
+						rejectExec(ch, err.Error())
+						return
+					}
+					gitcmd.Repo = repoName
+
+					allowed, message := s.authorize(identity, gitcmd, log)
+					if !allowed {
+						if message == "" {
+							message = "Access denied."
+						}
+						rejectExec(ch, message)
+						return
+					}
+
+					notices := []string{}
+					if message != "" {
+						notices = append(notices, message)
+					}
+
+					if message, blocked := s.config.Modes.pushBlocked(gitcmd.Repo); blocked && rpcService(gitcmd.Command) == ServiceReceivePack {
+						log.Warn("ssh: modes", "error", message)
+						rejectExec(ch, message)
+						return
+					}
+
+					ctx, cancel := s.commandContext(gitcmd.Command)
+					defer cancel()
+
+					release, err := s.limiter.acquire(ctx, gitcmd.Repo, identity)
+					if err != nil {
+						log.Warn("limits", "error", err)
+						rejectExec(ch, ErrTooManyRequests.Error())
 						return
 					}
+					defer release()
 
-					if !repoExists(filepath.Join(s.config.Dir, gitcmd.Repo)) && s.config.AutoCreate {
-						err := initRepo(gitcmd.Repo, s.config)
+					if !repoExists(repoPath) && s.config.AutoCreate {
+						err := initRepo(repoPath, s.config)
 						if err != nil {
-							logError("repo-init", err)
+							log.Error("repo-init", "error", err)
 							return
 						}
 					}
 
-					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-					cmd.Dir = s.config.Dir
-					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
+					// Command could be in "git-upload-pack" or "git upload-pack" form
+					cmd := exec.Command(s.config.GitPath, s.config.serviceArgs(gitcmd.Command, gitcmd.Repo, repoPath)...)
+					cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+					remoteAddr := conn.RemoteAddr().String()
+					if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+						remoteAddr = host
+					}
+					// Session variables come last, so clients could not override them
+					session := sessionEnv(identity, gitcmd.Repo, remoteAddr, reqID)
+					cmd.Env = append(os.Environ(), env...)
+					cmd.Env = append(cmd.Env, session...)
+
+					if rpcService(gitcmd.Command) == ServiceReceivePack {
+						hookEnv, err := s.hooks.env()
+						if err != nil {
+							log.Error("ssh: cant start hook server", "error", err)
+							return
+						}
+						cmd.Env = append(cmd.Env, hookEnv...)
+					}
 					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
 
 					stdout, err := cmd.StdoutPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
+						log.Error("ssh: cant open stdout pipe", "error", err)
 						return
 					}
 
 					stderr, err := cmd.StderrPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
+						log.Error("ssh: cant open stderr pipe", "error", err)
 						return
 					}
 
 					input, err := cmd.StdinPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
+						log.Error("ssh: cant open stdin pipe", "error", err)
 						return
 					}
 
+					obs := observe(s.Observer, Event{
+						Transport:  TransportSSH,
+						Repo:       gitcmd.Repo,
+						Service:    subCommand(gitcmd.Command),
+						Identity:   identity,
+						RemoteAddr: conn.RemoteAddr().String(),
+					}, ch, ch)
+
 					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
+						log.Error("ssh: start error", "error", err)
+						obs.finish(err)
 						return
 					}
+					defer s.tracker.addProcess(cmd)()
+					defer killOnDone(ctx, cmd)()
 
 					req.Reply(true, nil)
-					go io.Copy(input, ch)
-					io.Copy(ch, stdout)
+					go func() {
+						// Protocol v2 serves commands until stdin is closed
+						defer input.Close()
+
+						var stdin io.Reader = obs.in
+						if rpcService(gitcmd.Command) == ServiceReceivePack && len(s.config.RefPolicies) > 0 {
+							replay, report, err := enforceRefPolicies(s.config, session, gitcmd.Repo, repoPath, obs.in)
+							if err != nil {
+								// Receive-pack is idle until it gets commands, so the client only sees this error
+								log.Error("ssh: ref policies failed", "error", err)
+								pktline.NewEncoder(obs.out).Error("internal server error")
+								cmd.Process.Kill()
+								return
+							}
+
+							// Receive-pack is idle until it gets commands, so report could be sent right away.
+							// Empty command list lets receive-pack exit without errors.
+							if replay == nil {
+								log.Warn("ssh: push rejected by ref policy")
+								obs.out.Write(report)
+								pktline.NewEncoder(input).Flush()
+								return
+							}
+
+							defer replay.Close()
+							stdin = replay
+						}
+
+						if rpcService(gitcmd.Command) == ServiceUploadPack && s.config.denyShallow(gitcmd.Repo) {
+							stdin = newShallowGuard(stdin)
+						}
+
+						// Upload-pack is waiting for the rest of the request, so it's safe to respond
+						if _, err := io.Copy(input, stdin); err == ErrShallowDenied {
+							log.Warn("ssh: shallow fetch rejected")
+							pktline.NewEncoder(obs.out).Error(err.Error())
+							cmd.Process.Kill()
+						}
+					}()
+					io.Copy(newNoticeWriter(obs.out, notices), stdout)
 					io.Copy(ch.Stderr(), stderr)
 
-					if err = cmd.Wait(); err != nil {
-						log.Printf("ssh: command failed: %v", err)
+					err = cmd.Wait()
+					obs.exited(err)
+					obs.finish(err)
+
+					if err != nil {
+						log.Error("ssh: command failed", "error", err, "duration", time.Since(start))
+						ch.SendRequest("exit-status", false, exitStatus(commandExitCode(err)))
 						return
 					}
 
-					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					if rpcService(gitcmd.Command) == ServiceReceivePack && s.config.DumbHTTP {
+						if err := updateServerInfo(s.config, repoPath); err != nil {
+							log.Error("ssh: update-server-info", "error", err)
+						}
+					}
+
+					log.Debug("ssh: command finished", "duration", time.Since(start))
+					ch.SendRequest("exit-status", false, exitStatus(0))
 					return
 				default:
 					ch.Write([]byte("Unsupported request type.\r\n"))
-					log.Println("ssh: unsupported req type:", req.Type)
+					log.Warn("ssh: unsupported request type", "type", req.Type)
 					return
 				}
 			}
@@ -195,6 +397,15 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 	}
 }
 
+// commandContext returns a context for git process that is cancelled when the
+// service timeout is reached.
+func (s *SSH) commandContext(rpc string) (context.Context, context.CancelFunc) {
+	if timeout := s.config.Timeouts.forService(rpc); timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func (s *SSH) createServerKey() error {
 	if err := os.MkdirAll(s.config.KeyDir, os.ModePerm); err != nil {
 		return err
@@ -259,7 +470,7 @@ func (s *SSH) setup() error {
 				return nil, fmt.Errorf("auth handler did not return a key")
 			}
 
-			return &ssh.Permissions{Extensions: map[string]string{"key-id": pkey.Id}}, nil
+			return &ssh.Permissions{Extensions: map[string]string{"key-id": pkey.Id, "username": pkey.Username}}, nil
 		}
 	}
 
@@ -312,40 +523,42 @@ func (s *SSH) Serve() error {
 		return ErrNoListener
 	}
 
+	listener := s.listener
 	for {
-		// wait for connection or Stop()
-		conn, err := s.listener.Accept()
+		// wait for connection, Stop() or Shutdown()
+		conn, err := listener.Accept()
 		if err != nil {
+			if s.tracker.isClosing() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
 		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+			defer s.tracker.addConn(conn)()
+
+			log := s.config.logger()
+			log.Debug("ssh: handshaking", "remote_addr", conn.RemoteAddr())
 
 			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshconfig)
 			if err != nil {
 				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
+					log.Warn("ssh: handshaking was terminated", "remote_addr", conn.RemoteAddr(), "error", err)
 				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
+					log.Error("ssh: error on handshaking", "remote_addr", conn.RemoteAddr(), "error", err)
 				}
 				return
 			}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+			log.Info("ssh: connection", "remote_addr", sConn.RemoteAddr(), "client_version", string(sConn.ClientVersion()))
 
 			if s.config.Auth && s.config.GitUser != "" && sConn.User() != s.config.GitUser {
 				sConn.Close()
 				return
 			}
 
-			keyId := ""
-			if sConn.Permissions != nil {
-				keyId = sConn.Permissions.Extensions["key-id"]
-			}
-
 			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(keyId, chans)
+			s.handleConnection(sConn, chans)
 		}()
 	}
 }
@@ -366,9 +579,24 @@ func (s *SSH) Stop() error {
 		s.listener = nil
 	}()
 
+	s.hooks.close()
 	return s.listener.Close()
 }
 
+// Shutdown stops accepting connections and git commands, and waits for active
+// commands to finish. Git processes still running when the context is done are
+// killed. All client connections are closed afterwards.
+func (s *SSH) Shutdown(ctx context.Context) error {
+	s.tracker.close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	err := s.tracker.shutdown(ctx)
+	s.hooks.close()
+	return err
+}
+
 // Address returns the network address of the listener. This is in
 // particular useful when binding to :0 to get a free port assigned by
 // the OS.
@@ -0,0 +1,150 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSSH starts an ssh git server with repositories in a temp directory.
+// Setup funcs configure the server before it starts serving connections.
+func newTestSSH(t *testing.T, cfg Config, setup ...func(*SSH)) (*SSH, string) {
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	if cfg.KeyDir == "" {
+		cfg.KeyDir = t.TempDir()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = testLogger
+	}
+
+	server := NewSSH(cfg)
+	for _, fn := range setup {
+		fn(server)
+	}
+	require.NoError(t, server.Listen("127.0.0.1:0"))
+	go server.Serve()
+	t.Cleanup(func() { server.Stop() })
+
+	_, port, err := net.SplitHostPort(server.Address())
+	require.NoError(t, err)
+
+	return server, port
+}
+
+// sshCommand returns GIT_SSH_COMMAND environment for connecting to a test server
+func sshCommand(port string) string {
+	return fmt.Sprintf("GIT_SSH_COMMAND=ssh -p %s -o BatchMode=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR", port)
+}
+
+func TestSSH_acceptEnv(t *testing.T) {
+	s := NewSSH(Config{AllowedEnv: []string{"LANG"}})
+
+	value, ok := s.acceptEnv("GIT_PROTOCOL", "version=2")
+	assert.True(t, ok)
+	assert.Equal(t, "version=2", value)
+
+	_, ok = s.acceptEnv("GIT_PROTOCOL", "version 2")
+	assert.False(t, ok)
+
+	value, ok = s.acceptEnv("LANG", "en_US.UTF-8")
+	assert.True(t, ok)
+	assert.Equal(t, "en_US.UTF-8", value)
+
+	_, ok = s.acceptEnv("LD_PRELOAD", "/tmp/evil.so")
+	assert.False(t, ok)
+}
+
+func Test_commandExitCode(t *testing.T) {
+	assert.Equal(t, uint32(0), commandExitCode(nil))
+	assert.Equal(t, uint32(1), commandExitCode(fmt.Errorf("failed")))
+	assert.Equal(t, uint32(3), commandExitCode(exec.Command("sh", "-c", "exit 3").Run()))
+	assert.Equal(t, uint32(1), commandExitCode(exec.Command("sh", "-c", "kill -9 $$").Run()))
+}
+
+func TestSSHProtocolV2(t *testing.T) {
+	_, port := newTestSSH(t, Config{AutoCreate: true})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port), "GIT_TRACE_PACKET=1"}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, env, "-c", "protocol.version=2", "clone", url, "clone")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stderr, "< version 2")
+	assert.Contains(t, stderr, "> command=fetch")
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+
+	_, stderr, err = runGit(t, dest, env, "-c", "protocol.version=0", "ls-remote", url)
+	require.NoError(t, err, stderr)
+	assert.NotContains(t, stderr, "< version 2")
+}
+
+func TestSSHUploadArchive(t *testing.T) {
+	_, port := newTestSSH(t, Config{AutoCreate: true})
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port)
+	env := []string{sshCommand(port)}
+
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	stdout, stderr, err := runGit(t, work, env, "archive", "--remote="+url, "--format=tar", "master")
+	require.NoError(t, err, stderr)
+	assert.Contains(t, stdout, "README")
+	assert.Contains(t, stdout, "hello")
+}
+
+func TestSSHServiceTimeout(t *testing.T) {
+	gitPath, pidFile := newSlowGit(t)
+	_, port := newTestSSH(t, Config{
+		GitPath:  gitPath,
+		Timeouts: Timeouts{UploadPack: 200 * time.Millisecond},
+	})
+
+	start := time.Now()
+	_, _, err := runGit(t, t.TempDir(), []string{sshCommand(port)}, "ls-remote", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port))
+	assert.Error(t, err)
+
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.True(t, waitProcessExit(t, pidFile), "git process is still running")
+}
+
+func TestSSHKeyOwner(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).Run())
+
+	var update *HookInfo
+	callbacks := &HookCallbacks{
+		PreReceive: func(call *HookCall) error {
+			update = call.Updates[0]
+			return nil
+		},
+	}
+
+	_, port := newTestSSH(t, Config{AutoCreate: true, AutoHooks: true, Auth: true, HookCallbacks: callbacks}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+			return &PublicKey{Id: "12345", Username: "alice"}, nil
+		}
+	})
+
+	env := []string{sshCommand(port) + " -i " + keyPath + " -o IdentitiesOnly=yes"}
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", fmt.Sprintf("ssh://git@127.0.0.1:%s/test.git", port), "master")
+	require.NoError(t, err, stderr)
+
+	// Key owner is the user of hooks and LFS lock checks
+	require.NotNil(t, update)
+	assert.Equal(t, "alice", update.User)
+	assert.Equal(t, "12345", update.KeyID)
+}
@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sosedoff/gitkit/pktline"
+)
+
+// ErrShallowDenied is returned for shallow clones and fetches of repositories
+// that do not allow them.
+var ErrShallowDenied = errors.New("shallow clones are not allowed for this repository")
+
+// UploadPackOptions controls fetch features offered by upload-pack. Once set
+// for a repository, options that are not enabled are turned off, overriding
+// git configuration.
+type UploadPackOptions struct {
+	AllowFilter              bool // Allow partial clones with --filter
+	AllowAnySHA1InWant       bool // Allow fetching any object by its id
+	AllowTipSHA1InWant       bool // Allow fetching objects at the tips of hidden refs
+	AllowReachableSHA1InWant bool // Allow fetching objects reachable from any ref
+	DenyShallow              bool // Reject --depth, --shallow-since and --shallow-exclude fetches
+}
+
+// configArgs returns git -c arguments setting each option
+func (o UploadPackOptions) configArgs() []string {
+	settings := []struct {
+		enabled bool
+		name    string
+	}{
+		{o.AllowFilter, "uploadpack.allowFilter"},
+		{o.AllowAnySHA1InWant, "uploadpack.allowAnySHA1InWant"},
+		{o.AllowTipSHA1InWant, "uploadpack.allowTipSHA1InWant"},
+		{o.AllowReachableSHA1InWant, "uploadpack.allowReachableSHA1InWant"},
+	}
+
+	args := []string{}
+	for _, setting := range settings {
+		args = append(args, "-c", fmt.Sprintf("%s=%t", setting.name, setting.enabled))
+	}
+	return args
+}
+
+// uploadPackOptions returns upload-pack options for the repository, or false
+// if none are set and git configuration decides
+func (c *Config) uploadPackOptions(repo string) (UploadPackOptions, bool) {
+	if options, ok := c.RepoUploadPack[repo]; ok {
+		return options, true
+	}
+	if c.UploadPack != nil {
+		return *c.UploadPack, true
+	}
+	return UploadPackOptions{}, false
+}
+
+// denyShallow returns true if shallow fetches of the repository are rejected
+func (c *Config) denyShallow(repo string) bool {
+	options, _ := c.uploadPackOptions(repo)
+	return options.DenyShallow
+}
+
+// serviceArgs returns git arguments to run the service on the repository
+func (c *Config) serviceArgs(rpc string, repo string, args ...string) []string {
+	result := []string{}
+	if options, ok := c.uploadPackOptions(repo); ok && rpcService(rpc) == ServiceUploadPack {
+		result = append(result, options.configArgs()...)
+	}
+
+	result = append(result, subCommand(rpc))
+	return append(result, args...)
+}
+
+// shallowGuard passes upload-pack requests through, failing with ErrShallowDenied
+// on requests for shallow history. All client requests of both protocol v0 and
+// v2 are pkt-lines, so packets are checked before they reach git.
+type shallowGuard struct {
+	scanner *pktline.Scanner
+	buf     []byte
+}
+
+func newShallowGuard(r io.Reader) *shallowGuard {
+	return &shallowGuard{scanner: pktline.NewScanner(r)}
+}
+
+func (g *shallowGuard) Read(p []byte) (int, error) {
+	if len(g.buf) == 0 {
+		if !g.scanner.Scan() {
+			if err := g.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+
+		if strings.HasPrefix(g.scanner.Text(), "deepen") {
+			return 0, ErrShallowDenied
+		}
+		g.buf = g.scanner.Raw()
+	}
+
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+	return n, nil
+}
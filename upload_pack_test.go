@@ -0,0 +1,163 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_serviceArgs(t *testing.T) {
+	config := Config{
+		UploadPack: &UploadPackOptions{AllowFilter: true},
+		RepoUploadPack: map[string]UploadPackOptions{
+			"big.git":   {AllowFilter: true, AllowReachableSHA1InWant: true},
+			"small.git": {},
+		},
+	}
+
+	assert.Equal(t,
+		[]string{
+			"-c", "uploadpack.allowFilter=true",
+			"-c", "uploadpack.allowAnySHA1InWant=false",
+			"-c", "uploadpack.allowTipSHA1InWant=false",
+			"-c", "uploadpack.allowReachableSHA1InWant=false",
+			"upload-pack", "--stateless-rpc", "/repos/test.git",
+		},
+		config.serviceArgs("git-upload-pack", "test.git", "--stateless-rpc", "/repos/test.git"),
+	)
+	assert.Equal(t,
+		[]string{
+			"-c", "uploadpack.allowFilter=true",
+			"-c", "uploadpack.allowAnySHA1InWant=false",
+			"-c", "uploadpack.allowTipSHA1InWant=false",
+			"-c", "uploadpack.allowReachableSHA1InWant=true",
+			"upload-pack", "/repos/big.git",
+		},
+		config.serviceArgs("git-upload-pack", "big.git", "/repos/big.git"),
+	)
+	assert.Equal(t,
+		[]string{
+			"-c", "uploadpack.allowFilter=false",
+			"-c", "uploadpack.allowAnySHA1InWant=false",
+			"-c", "uploadpack.allowTipSHA1InWant=false",
+			"-c", "uploadpack.allowReachableSHA1InWant=false",
+			"upload-pack", "/repos/small.git",
+		},
+		config.serviceArgs("git-upload-pack", "small.git", "/repos/small.git"),
+	)
+	assert.Equal(t,
+		[]string{"receive-pack", "/repos/test.git"},
+		config.serviceArgs("git-receive-pack", "test.git", "/repos/test.git"),
+	)
+
+	// Git configuration is left alone without options
+	config.UploadPack = nil
+	assert.Equal(t,
+		[]string{"upload-pack", "/repos/test.git"},
+		config.serviceArgs("git-upload-pack", "test.git", "/repos/test.git"),
+	)
+}
+
+func TestShallowGuard(t *testing.T) {
+	input := bytes.NewBuffer(nil)
+	packLine(input, "want "+testNewRev+" side-band-64k\n")
+	packFlush(input)
+	packLine(input, "done\n")
+
+	data, err := ioutil.ReadAll(newShallowGuard(bytes.NewReader(input.Bytes())))
+	require.NoError(t, err)
+	assert.Equal(t, input.Bytes(), data)
+
+	input.Reset()
+	packLine(input, "want "+testNewRev+"\n")
+	packLine(input, "deepen 1\n")
+	packFlush(input)
+
+	_, err = ioutil.ReadAll(newShallowGuard(input))
+	assert.Equal(t, ErrShallowDenied, err)
+}
+
+// testPartialClone pushes a commit to url and clones it with given options
+func testPartialClone(t *testing.T, url string, env []string, args ...string) (string, error) {
+	work := newWorkTree(t)
+	_, stderr, err := runGit(t, work, env, "push", "--force", url, "master")
+	require.NoError(t, err, stderr)
+
+	dest := t.TempDir()
+	args = append([]string{"clone"}, append(args, url, "clone")...)
+	_, stderr, err = runGit(t, dest, env, args...)
+	return stderr, err
+}
+
+func TestPartialClone(t *testing.T) {
+	for _, version := range []string{"0", "2"} {
+		server, ts := newTestServer(t, Config{
+			AutoCreate: true,
+			RepoUploadPack: map[string]UploadPackOptions{
+				"big.git":    {AllowFilter: true, AllowReachableSHA1InWant: true},
+				"small.git":  {DenyShallow: true},
+				"locked.git": {},
+			},
+		})
+		env := []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=protocol.version", "GIT_CONFIG_VALUE_0=" + version}
+
+		stderr, err := testPartialClone(t, ts.URL+"/big.git", env, "--filter=blob:none")
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stderr, "filtering not recognized by server")
+
+		stderr, err = testPartialClone(t, ts.URL+"/other.git", env, "--filter=blob:none")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "filtering not recognized by server")
+
+		// Options override git config of the repository, which is used without them
+		for _, name := range []string{"locked.git", "own.git"} {
+			mustGit(t, server.config.Dir, "init", "--bare", name)
+			mustGit(t, filepath.Join(server.config.Dir, name), "config", "uploadpack.allowFilter", "true")
+			mustGit(t, filepath.Join(server.config.Dir, name), "config", "uploadpack.allowReachableSHA1InWant", "true")
+		}
+		stderr, err = testPartialClone(t, ts.URL+"/locked.git", env, "--filter=blob:none")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "filtering not recognized by server")
+
+		stderr, err = testPartialClone(t, ts.URL+"/own.git", env, "--filter=blob:none")
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stderr, "filtering not recognized by server")
+
+		stderr, err = testPartialClone(t, ts.URL+"/small.git", env, "--depth=1")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "shallow clones are not allowed for this repository")
+
+		stderr, err = testPartialClone(t, ts.URL+"/other.git", env, "--depth=1")
+		require.NoError(t, err, stderr)
+	}
+}
+
+func TestSSHPartialClone(t *testing.T) {
+	_, port := newTestSSH(t, Config{
+		AutoCreate: true,
+		RepoUploadPack: map[string]UploadPackOptions{
+			"big.git":   {AllowFilter: true, AllowReachableSHA1InWant: true},
+			"small.git": {DenyShallow: true},
+		},
+	})
+	env := []string{sshCommand(port)}
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%s", port)
+
+	stderr, err := testPartialClone(t, url+"/big.git", env, "--filter=blob:none")
+	require.NoError(t, err, stderr)
+	assert.NotContains(t, stderr, "filtering not recognized by server")
+
+	stderr, err = testPartialClone(t, url+"/small.git", env, "--depth=1")
+	require.Error(t, err)
+	assert.Contains(t, stderr, "shallow clones are not allowed for this repository")
+
+	dest := t.TempDir()
+	_, stderr, err = runGit(t, dest, env, "clone", url+"/big.git", "clone")
+	require.NoError(t, err, stderr)
+	assert.FileExists(t, filepath.Join(dest, "clone", "README"))
+}
@@ -1,29 +1,30 @@
 package gitkit
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"log"
 	"net/http"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
-)
+	"time"
 
-var reSlashDedup = regexp.MustCompile(`\/{2,}`)
+	"github.com/gofrs/uuid"
 
-func fail500(w http.ResponseWriter, context string, err error) {
-	http.Error(w, "Internal server error", 500)
-	logError(context, err)
-}
+	"github.com/sosedoff/gitkit/pktline"
+)
 
-func logError(context string, err error) {
-	log.Printf("%s: %v\n", context, err)
-}
+var (
+	reSlashDedup   = regexp.MustCompile(`\/{2,}`)
+	reProtocolPart = regexp.MustCompile(`^[a-zA-Z0-9._-]+(=[a-zA-Z0-9._-]+)?$`)
+	reRequestID    = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+)
 
-func logInfo(context string, message string) {
-	log.Printf("%s: %s\n", context, message)
+func fail500(w http.ResponseWriter, log Logger, context string, err error) {
+	http.Error(w, "Internal server error", 500)
+	log.Error(context, "error", err)
 }
 
 func cleanUpProcessGroup(cmd *exec.Cmd) {
@@ -31,26 +32,113 @@ func cleanUpProcessGroup(cmd *exec.Cmd) {
 		return
 	}
 
+	killProcessGroup(cmd)
+	go cmd.Wait()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
 	process := cmd.Process
 	if process != nil && process.Pid > 0 {
 		syscall.Kill(-process.Pid, syscall.SIGTERM)
 	}
+}
 
-	go cmd.Wait()
+// killOnDone terminates the process group of a started command once the
+// context is done. Returned function must be called after the command exits.
+func killOnDone(ctx context.Context, cmd *exec.Cmd) func() {
+	stop := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-stop:
+		}
+	}()
+
+	return func() { close(stop) }
 }
 
 func packLine(w io.Writer, s string) error {
-	_, err := fmt.Fprintf(w, "%04x%s", len(s)+4, s)
-	return err
+	return pktline.NewEncoder(w).EncodeString(s)
 }
 
 func packFlush(w io.Writer) error {
-	_, err := fmt.Fprint(w, "0000")
-	return err
+	return pktline.NewEncoder(w).Flush()
 }
 
+// parseGitProtocol sanitizes the value of Git-Protocol header or GIT_PROTOCOL
+// variable, dropping any malformed parameters.
+// Examples:
+// version=2 -> "version=2"
+// version=2:object-format=sha1 -> "version=2:object-format=sha1"
+// version=2;rm -rf -> ""
+func parseGitProtocol(input string) string {
+	parts := []string{}
+	for _, part := range strings.Split(input, ":") {
+		if reProtocolPart.MatchString(part) {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+// sessionEnv returns variables for git processes and hooks that describe who
+// runs the command and where it comes from.
+func sessionEnv(identity Identity, repo string, remoteAddr string, requestID string) []string {
+	env := []string{
+		"GITKIT_REPO=" + repo,
+		"GITKIT_REMOTE_ADDR=" + remoteAddr,
+		"GITKIT_REQUEST_ID=" + requestID,
+	}
+	if identity.Username != "" {
+		env = append(env, "GITKIT_USER="+identity.Username, "REMOTE_USER="+identity.Username)
+	}
+	if identity.KeyID != "" {
+		env = append(env, "GITKIT_KEY="+identity.KeyID)
+	}
+	return env
+}
+
+// envLookup returns a getenv function for the list of "NAME=value" variables
+func envLookup(env []string) func(string) string {
+	vars := map[string]string{}
+	for _, item := range env {
+		if chunks := strings.SplitN(item, "=", 2); len(chunks) == 2 {
+			vars[chunks[0]] = chunks[1]
+		}
+	}
+	return func(name string) string { return vars[name] }
+}
+
+// requestID returns the request id sent by the client or proxy if it's safe
+// to use, otherwise a new random id.
+func requestID(header string) string {
+	if reRequestID.MatchString(header) {
+		return header
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return id.String()
+}
+
+// isProtocolV2 returns true if the client requested git wire protocol v2
+func isProtocolV2(protocol string) bool {
+	for _, part := range strings.Split(protocol, ":") {
+		if part == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// subCommand returns git subcommand for a service in either "git-upload-pack"
+// or "git upload-pack" form.
 func subCommand(rpc string) string {
-	return strings.TrimPrefix(rpc, "git-")
+	return strings.TrimPrefix(strings.TrimPrefix(rpc, "git-"), "git ")
 }
 
 // Parse out namespace and repository name from the path.
@@ -80,3 +168,12 @@ func getNamespaceAndRepo(input string) (string, string) {
 
 	return strings.Join(blocks[0:num-1], "/"), blocks[num-1]
 }
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
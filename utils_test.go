@@ -11,6 +11,7 @@ func Test_subCommand(t *testing.T) {
 	cases := map[string]string{
 		"git-receive-pack": "receive-pack",
 		"git-upload-pack":  "upload-pack",
+		"git upload-pack":  "upload-pack",
 		"git-foobar":       "foobar",
 		"git":              "git",
 		"foobar":           "foobar",
@@ -75,3 +76,47 @@ func Test_getNamespaceAndRepo(t *testing.T) {
 		assert.Equal(t, expected[1], repo)
 	}
 }
+
+func Test_parseGitProtocol(t *testing.T) {
+	cases := map[string]string{
+		"":                             "",
+		"version=2":                    "version=2",
+		"version=2:object-format=sha1": "version=2:object-format=sha1",
+		"version=1:bad value":          "version=1",
+		"version=2;rm -rf":             "",
+	}
+
+	for example, expected := range cases {
+		assert.Equal(t, expected, parseGitProtocol(example))
+	}
+
+	assert.True(t, isProtocolV2("version=2"))
+	assert.True(t, isProtocolV2("object-format=sha1:version=2"))
+	assert.False(t, isProtocolV2("version=1"))
+	assert.False(t, isProtocolV2(""))
+}
+
+func Test_requestID(t *testing.T) {
+	assert.Equal(t, "abc-123", requestID("abc-123"))
+	assert.Len(t, requestID(""), 36)
+	assert.Len(t, requestID("evil\nheader"), 36)
+	assert.NotEqual(t, requestID(""), requestID(""))
+}
+
+func Test_sessionEnv(t *testing.T) {
+	assert.Equal(t,
+		[]string{"GITKIT_REPO=org/repo.git", "GITKIT_REMOTE_ADDR=10.0.0.1", "GITKIT_REQUEST_ID=abc", "GITKIT_USER=john", "REMOTE_USER=john"},
+		sessionEnv(Identity{Username: "john"}, "org/repo.git", "10.0.0.1", "abc"),
+	)
+	assert.Equal(t,
+		[]string{"GITKIT_REPO=repo.git", "GITKIT_REMOTE_ADDR=10.0.0.1", "GITKIT_REQUEST_ID=abc", "GITKIT_KEY=123"},
+		sessionEnv(Identity{KeyID: "123"}, "repo.git", "10.0.0.1", "abc"),
+	)
+}
+
+func Test_envLookup(t *testing.T) {
+	getenv := envLookup([]string{"GITKIT_USER=john", "GITKIT_REQUEST_ID=a=b", "INVALID"})
+	assert.Equal(t, "john", getenv("GITKIT_USER"))
+	assert.Equal(t, "a=b", getenv("GITKIT_REQUEST_ID"))
+	assert.Equal(t, "", getenv("INVALID"))
+}
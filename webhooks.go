@@ -0,0 +1,634 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// maxWebhookCommits limits the number of commits listed for each ref
+	maxWebhookCommits = 20
+
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = 10 * time.Second
+	defaultWebhookTimeout  = 30 * time.Second
+)
+
+// Webhook is an HTTP endpoint notified about pushes
+type Webhook struct {
+	ID     string // Identifier that ties queued deliveries to the webhook, defaults to URL. Must be unique
+	URL    string
+	Secret string // Key for HMAC-SHA256 signature in X-Gitkit-Signature header, payloads are not signed if empty
+}
+
+// id returns the identifier of the webhook
+func (h Webhook) id() string {
+	if h.ID != "" {
+		return h.ID
+	}
+	return h.URL
+}
+
+// PushEvent is the JSON payload of webhook deliveries
+type PushEvent struct {
+	Repo   string    `json:"repository"`
+	Pusher string    `json:"pusher,omitempty"`
+	Refs   []PushRef `json:"refs"`
+}
+
+// PushRef is a single ref update of the push
+type PushRef struct {
+	Ref     string       `json:"ref"`
+	Action  string       `json:"action"`
+	Before  string       `json:"before"`
+	After   string       `json:"after"`
+	Commits []PushCommit `json:"commits"`
+}
+
+// PushCommit is a commit added to the ref, newest first
+type PushCommit struct {
+	ID        string `json:"id"`
+	Message   string `json:"message"`
+	Author    string `json:"author"`
+	Email     string `json:"email"`
+	Timestamp string `json:"timestamp"`
+}
+
+// WebhookDelivery is a record of the delivery log
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	Repo       string    `json:"repository"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	Time       time.Time `json:"time"`
+}
+
+// webhookTask is a queued delivery stored on disk
+type webhookTask struct {
+	ID          string          `json:"id"`
+	Repo        string          `json:"repository"`
+	Hook        string          `json:"hook"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Webhooks delivers push events to webhook endpoints. Deliveries are queued in
+// Dir, so they survive restarts, and failed ones are retried with exponential
+// backoff. Use PostReceive as post-receive hook callback to feed push events.
+type Webhooks struct {
+	Dir         string               // Directory for the queue and delivery log
+	Hooks       []Webhook            // Webhooks for all repositories
+	RepoHooks   map[string][]Webhook // Additional webhooks per repository
+	MaxAttempts int                  // Attempts per delivery, defaults to 5
+	Backoff     time.Duration        // Delay before the first retry, doubled for each next one. Defaults to 10s
+	Client      *http.Client         // Client for deliveries, defaults to client with 30s timeout
+	Logger      Logger               // Defaults to standard logger
+
+	mu      sync.Mutex // Guards the queue and the log
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	busy    map[string]bool // Endpoints with deliveries in progress
+	workers sync.WaitGroup
+}
+
+// PostReceive is a HookFunc that queues push event of the call
+func (w *Webhooks) PostReceive(call *HookCall) error {
+	event := PushEvent{Repo: call.RepoName, Refs: []PushRef{}}
+	if len(call.Updates) > 0 {
+		// SSH keys without owner are identified by key id
+		event.Pusher = call.Updates[0].User
+		if event.Pusher == "" {
+			event.Pusher = call.Updates[0].KeyID
+		}
+	}
+
+	gitPath := call.GitPath
+	if gitPath == "" {
+		gitPath = "git"
+	}
+
+	for _, update := range call.Updates {
+		commits, err := pushCommits(gitPath, update, call.Updates)
+		if err != nil {
+			return err
+		}
+
+		event.Refs = append(event.Refs, PushRef{
+			Ref:     update.Ref,
+			Action:  update.Action,
+			Before:  update.OldRev,
+			After:   update.NewRev,
+			Commits: commits,
+		})
+	}
+
+	return w.Push(event)
+}
+
+// Push queues the event for webhooks of its repository
+func (w *Webhooks) Push(event PushEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	hooks := append(append([]Webhook{}, w.Hooks...), w.RepoHooks[event.Repo]...)
+	for _, hook := range hooks {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+
+		task := webhookTask{
+			ID:          id.String(),
+			Repo:        event.Repo,
+			Hook:        hook.id(),
+			URL:         hook.URL,
+			Payload:     payload,
+			NextAttempt: time.Now(),
+			CreatedAt:   time.Now(),
+		}
+
+		w.mu.Lock()
+		err = w.saveTask(task)
+		w.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(hooks) > 0 {
+		w.notify()
+	}
+	return nil
+}
+
+// Start runs delivery of queued events in background until Stop is called
+func (w *Webhooks) Start() error {
+	if err := os.MkdirAll(w.queueDir(), 0755); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stop != nil {
+		return ErrAlreadyStarted
+	}
+
+	w.wake = make(chan struct{}, 1)
+	w.stop = make(chan struct{})
+	w.stopped = make(chan struct{})
+	go w.run(w.wake, w.stop, w.stopped)
+
+	return nil
+}
+
+// Stop stops delivery and waits for the current ones to finish. Queued events
+// are delivered after the next Start.
+func (w *Webhooks) Stop() {
+	w.mu.Lock()
+	stop, stopped := w.stop, w.stopped
+	w.stop = nil
+	w.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Deliveries returns the delivery log, oldest first
+func (w *Webhooks) Deliveries() ([]WebhookDelivery, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+
+	file, err := os.Open(w.logPath())
+	if os.IsNotExist(err) {
+		return deliveries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		delivery := WebhookDelivery{}
+		if err := json.Unmarshal(scanner.Bytes(), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, scanner.Err()
+}
+
+func (w *Webhooks) run(wake, stop, stopped chan struct{}) {
+	defer close(stopped)
+	defer w.workers.Wait()
+
+	for {
+		next := w.deliverDue(stop)
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+
+		select {
+		case <-stop:
+		case <-wake:
+		case <-due:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// notify wakes up the delivery loop
+func (w *Webhooks) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.wake == nil {
+		return
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue starts delivery of queued tasks that are due and returns time of
+// the next attempt. Each endpoint gets its own worker, which delivers tasks in
+// order, so a slow endpoint does not hold up the others.
+func (w *Webhooks) deliverDue(stop chan struct{}) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tasks, err := w.loadTasks()
+	if err != nil {
+		w.logger().Error("webhooks: cant read queue", "error", err)
+		return time.Now().Add(w.backoff())
+	}
+
+	next := time.Time{}
+	due := map[string][]webhookTask{}
+	urls := []string{}
+	for _, task := range tasks {
+		if w.busy[task.URL] {
+			// Worker wakes up the loop when done
+			continue
+		}
+
+		if task.NextAttempt.After(time.Now()) {
+			if next.IsZero() || task.NextAttempt.Before(next) {
+				next = task.NextAttempt
+			}
+			continue
+		}
+
+		if due[task.URL] == nil {
+			urls = append(urls, task.URL)
+		}
+		due[task.URL] = append(due[task.URL], task)
+	}
+
+	if w.busy == nil {
+		w.busy = map[string]bool{}
+	}
+	for _, url := range urls {
+		w.busy[url] = true
+		w.workers.Add(1)
+		go w.deliverAll(url, due[url], stop)
+	}
+
+	return next
+}
+
+// deliverAll delivers tasks of the endpoint one by one
+func (w *Webhooks) deliverAll(url string, tasks []webhookTask, stop chan struct{}) {
+	defer w.workers.Done()
+
+loop:
+	for _, task := range tasks {
+		select {
+		case <-stop:
+			break loop
+		default:
+		}
+		w.deliver(task)
+	}
+
+	w.mu.Lock()
+	delete(w.busy, url)
+	w.mu.Unlock()
+
+	w.notify()
+}
+
+// deliver sends the task and updates the queue
+func (w *Webhooks) deliver(task webhookTask) {
+	task.Attempts++
+	log := withFields(w.logger(), "repo", task.Repo, "url", task.URL, "delivery", task.ID)
+
+	delivery := WebhookDelivery{ID: task.ID, Repo: task.Repo, URL: task.URL, Attempt: task.Attempts}
+
+	hook, ok := w.findHook(task)
+	if !ok {
+		delivery.Error = "webhook has been removed"
+	} else {
+		delivery.StatusCode, delivery.Error = w.send(hook, task)
+		delivery.Success = delivery.Error == ""
+	}
+	delivery.Time = time.Now().UTC()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.appendLog(delivery); err != nil {
+		log.Error("webhooks: cant write delivery log", "error", err)
+	}
+
+	if delivery.Success || !ok || task.Attempts >= w.maxAttempts() {
+		if delivery.Success {
+			log.Info("webhooks: delivered", "attempt", task.Attempts)
+		} else {
+			log.Error("webhooks: delivery failed", "attempt", task.Attempts, "error", delivery.Error)
+		}
+
+		if err := os.Remove(w.taskPath(task.ID)); err != nil {
+			log.Error("webhooks: cant remove task", "error", err)
+		}
+		return
+	}
+
+	log.Warn("webhooks: delivery attempt failed", "attempt", task.Attempts, "error", delivery.Error)
+	task.NextAttempt = time.Now().Add(w.backoff() << uint(task.Attempts-1))
+	if err := w.saveTask(task); err != nil {
+		log.Error("webhooks: cant update task", "error", err)
+	}
+}
+
+// send posts the payload and returns response status and error message
+func (w *Webhooks) send(hook Webhook, task webhookTask) (int, string) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(task.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gitkit/"+Version)
+	req.Header.Set("X-Gitkit-Event", "push")
+	req.Header.Set("X-Gitkit-Delivery", task.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Gitkit-Signature", SignWebhook(hook.Secret, task.Payload))
+	}
+
+	resp, err := w.client().Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, ""
+}
+
+// findHook returns the current configuration of the task webhook
+func (w *Webhooks) findHook(task webhookTask) (Webhook, bool) {
+	id := task.Hook
+	if id == "" {
+		// Queued before webhooks had identifiers
+		id = task.URL
+	}
+
+	for _, hook := range append(append([]Webhook{}, w.Hooks...), w.RepoHooks[task.Repo]...) {
+		if hook.id() == id {
+			return hook, true
+		}
+	}
+	return Webhook{}, false
+}
+
+func (w *Webhooks) queueDir() string {
+	return filepath.Join(w.Dir, "queue")
+}
+
+func (w *Webhooks) taskPath(id string) string {
+	return filepath.Join(w.queueDir(), id+".json")
+}
+
+func (w *Webhooks) logPath() string {
+	return filepath.Join(w.Dir, "deliveries.log")
+}
+
+// saveTask writes the task into the queue, replacing the file atomically
+func (w *Webhooks) saveTask(task webhookTask) error {
+	if err := os.MkdirAll(w.queueDir(), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(w.queueDir(), ".task-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), w.taskPath(task.ID))
+}
+
+// loadTasks returns queued tasks in order of creation
+func (w *Webhooks) loadTasks() ([]webhookTask, error) {
+	files, err := ioutil.ReadDir(w.queueDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []webhookTask{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(w.queueDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		task := webhookTask{}
+		if err := json.Unmarshal(data, &task); err != nil {
+			w.logger().Error("webhooks: invalid task", "file", file.Name(), "error", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.Before(tasks[j].CreatedAt) })
+	return tasks, nil
+}
+
+func (w *Webhooks) appendLog(delivery WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.logPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func (w *Webhooks) maxAttempts() int {
+	if w.MaxAttempts > 0 {
+		return w.MaxAttempts
+	}
+	return defaultWebhookAttempts
+}
+
+func (w *Webhooks) backoff() time.Duration {
+	if w.Backoff > 0 {
+		return w.Backoff
+	}
+	return defaultWebhookBackoff
+}
+
+func (w *Webhooks) client() *http.Client {
+	if w.Client != nil {
+		return w.Client
+	}
+	return &http.Client{Timeout: defaultWebhookTimeout}
+}
+
+func (w *Webhooks) logger() Logger {
+	if w.Logger != nil {
+		return w.Logger
+	}
+	return defaultLogger
+}
+
+// SignWebhook returns the signature of the payload in "sha256=<hex>" form, as
+// sent in X-Gitkit-Signature header. Receivers should compare it with hmac.Equal.
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// pushCommits lists commits added to the ref by the update, which is one of
+// the updates of the push.
+func pushCommits(gitPath string, update *HookInfo, push []*HookInfo) ([]PushCommit, error) {
+	commits := []PushCommit{}
+	if update.NewRev == ZeroSHA {
+		return commits, nil
+	}
+
+	args := []string{"log", fmt.Sprintf("--max-count=%d", maxWebhookCommits), "--format=%H%x00%an%x00%ae%x00%aI%x00%B%x1e", update.NewRev}
+	if update.OldRev == ZeroSHA {
+		// New ref, commits that were not reachable from any ref before the push
+		args = append(args, "--not")
+		for _, other := range push {
+			if other.OldRev != ZeroSHA {
+				args = append(args, other.OldRev)
+			}
+			args = append(args, "--exclude="+other.Ref)
+		}
+		args = append(args, "--glob=refs/*")
+	} else {
+		args = append(args, "^"+update.OldRev)
+	}
+
+	env, err := update.GitEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = update.RepoPath
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cant list pushed commits: %v", err)
+	}
+
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x00", 5)
+		if len(fields) != 5 {
+			continue
+		}
+
+		commits = append(commits, PushCommit{
+			ID:        fields[0],
+			Author:    fields[1],
+			Email:     fields[2],
+			Timestamp: fields[3],
+			Message:   strings.TrimSpace(fields[4]),
+		})
+	}
+
+	return commits, nil
+}
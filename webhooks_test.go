@@ -0,0 +1,316 @@
+package gitkit
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records webhook requests, failing the first ones with 500 status
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     int
+	requests []*http.Request
+	payloads [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.payloads = append(r.payloads, body)
+
+	if len(r.requests) <= r.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (r *webhookReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// waitDeliveries waits for the delivery log to have n records
+func waitDeliveries(t *testing.T, webhooks *Webhooks, n int) []WebhookDelivery {
+	deliveries := []WebhookDelivery{}
+	require.Eventually(t, func() bool {
+		var err error
+		deliveries, err = webhooks.Deliveries()
+		require.NoError(t, err)
+		return len(deliveries) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+func TestSignWebhook(t *testing.T) {
+	assert.Equal(t,
+		"sha256=5d5d139563c95b5967b9bd9a8c9b233a9dedb45072794cd232dc1b74832607d0",
+		SignWebhook("key", []byte("")),
+	)
+	assert.True(t, hmac.Equal([]byte(SignWebhook("key", []byte("a"))), []byte(SignWebhook("key", []byte("a")))))
+	assert.NotEqual(t, SignWebhook("key", []byte("a")), SignWebhook("other", []byte("a")))
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	receiver := &webhookReceiver{fail: 2}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	webhooks := &Webhooks{
+		Dir:       t.TempDir(),
+		RepoHooks: map[string][]Webhook{"org/app.git": {{URL: ts.URL + "/hook", Secret: "secret"}}},
+		Backoff:   10 * time.Millisecond,
+		Logger:    testLogger,
+	}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	require.NoError(t, webhooks.Push(PushEvent{Repo: "other.git"}))
+	event := PushEvent{Repo: "org/app.git", Refs: []PushRef{{Ref: "refs/heads/master", Before: ZeroSHA, After: testNewRev}}}
+	require.NoError(t, webhooks.Push(event))
+
+	deliveries := waitDeliveries(t, webhooks, 3)
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, 1, deliveries[0].Attempt)
+	assert.Equal(t, 500, deliveries[0].StatusCode)
+	assert.False(t, deliveries[0].Success)
+	assert.Equal(t, 3, deliveries[2].Attempt)
+	assert.Equal(t, 200, deliveries[2].StatusCode)
+	assert.True(t, deliveries[2].Success)
+	assert.Equal(t, deliveries[0].ID, deliveries[2].ID)
+	assert.Equal(t, "org/app.git", deliveries[2].Repo)
+	assert.True(t, deliveries[1].Time.Sub(deliveries[0].Time) >= 10*time.Millisecond)
+	assert.True(t, deliveries[2].Time.Sub(deliveries[1].Time) >= 20*time.Millisecond)
+
+	receiver.mu.Lock()
+	req, payload := receiver.requests[2], receiver.payloads[2]
+	receiver.mu.Unlock()
+
+	assert.Equal(t, "push", req.Header.Get("X-Gitkit-Event"))
+	assert.Equal(t, deliveries[2].ID, req.Header.Get("X-Gitkit-Delivery"))
+	assert.Equal(t, SignWebhook("secret", payload), req.Header.Get("X-Gitkit-Signature"))
+
+	received := PushEvent{}
+	require.NoError(t, json.Unmarshal(payload, &received))
+	assert.Equal(t, event, received)
+
+	files, err := ioutil.ReadDir(webhooks.queueDir())
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	receiver := &webhookReceiver{fail: 100}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	webhooks := &Webhooks{
+		Dir:         t.TempDir(),
+		Hooks:       []Webhook{{URL: ts.URL}},
+		MaxAttempts: 2,
+		Backoff:     10 * time.Millisecond,
+		Logger:      testLogger,
+	}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	require.NoError(t, webhooks.Push(PushEvent{Repo: "test.git"}))
+	deliveries := waitDeliveries(t, webhooks, 2)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, receiver.count())
+	assert.Len(t, deliveries, 2)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	assert.Empty(t, receiver.requests[0].Header.Get("X-Gitkit-Signature"))
+}
+
+func TestWebhooksPersistentQueue(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	hooks := []Webhook{{URL: ts.URL}}
+
+	// Events queued while delivery is not running are kept on disk
+	stopped := &Webhooks{Dir: dir, Hooks: hooks, Logger: testLogger}
+	require.NoError(t, stopped.Push(PushEvent{Repo: "test.git"}))
+	assert.Equal(t, 0, receiver.count())
+
+	webhooks := &Webhooks{Dir: dir, Hooks: hooks, Logger: testLogger}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	deliveries := waitDeliveries(t, webhooks, 1)
+	assert.True(t, deliveries[0].Success)
+	assert.Equal(t, 1, receiver.count())
+}
+
+func TestWebhooksSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	receiver := &webhookReceiver{}
+	fast := httptest.NewServer(receiver)
+	defer fast.Close()
+
+	webhooks := &Webhooks{Dir: t.TempDir(), Hooks: []Webhook{{URL: slow.URL}, {URL: fast.URL}}, Logger: testLogger}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	// Slow endpoint does not hold up deliveries to others
+	require.NoError(t, webhooks.Push(PushEvent{Repo: "test.git"}))
+	require.NoError(t, webhooks.Push(PushEvent{Repo: "test.git"}))
+	deliveries := waitDeliveries(t, webhooks, 2)
+	assert.Equal(t, fast.URL, deliveries[0].URL)
+	assert.Equal(t, fast.URL, deliveries[1].URL)
+
+	close(release)
+	deliveries = waitDeliveries(t, webhooks, 4)
+	assert.Equal(t, slow.URL, deliveries[3].URL)
+	assert.True(t, deliveries[3].Success)
+}
+
+func TestWebhooksSameURL(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	webhooks := &Webhooks{
+		Dir:       t.TempDir(),
+		Hooks:     []Webhook{{ID: "ci", URL: ts.URL, Secret: "one"}},
+		RepoHooks: map[string][]Webhook{"test.git": {{ID: "deploy", URL: ts.URL, Secret: "two"}}},
+		Logger:    testLogger,
+	}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	require.NoError(t, webhooks.Push(PushEvent{Repo: "test.git"}))
+	waitDeliveries(t, webhooks, 2)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	// Each delivery is signed with the secret of its own webhook
+	signatures := []string{}
+	for i, req := range receiver.requests {
+		signatures = append(signatures, req.Header.Get("X-Gitkit-Signature"))
+		payload := receiver.payloads[i]
+		assert.Contains(t, []string{SignWebhook("one", payload), SignWebhook("two", payload)}, signatures[i])
+	}
+	assert.NotEqual(t, signatures[0], signatures[1])
+}
+
+func TestWebhooksPostReceive(t *testing.T) {
+	webhooks := &Webhooks{Dir: t.TempDir(), Hooks: []Webhook{{URL: "http://127.0.0.1:1"}}, Logger: testLogger}
+
+	pushers := func() []string {
+		tasks, err := webhooks.loadTasks()
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, task := range tasks {
+			event := PushEvent{}
+			require.NoError(t, json.Unmarshal(task.Payload, &event))
+			names = append(names, event.Pusher)
+		}
+		return names
+	}
+
+	deletion := &HookInfo{Ref: "refs/heads/old", OldRev: testNewRev, NewRev: ZeroSHA, KeyID: "key-1"}
+	call := &HookCall{RepoName: "test.git", Updates: []*HookInfo{deletion}, Env: []string{"GITKIT_USER=spoofed"}}
+	require.NoError(t, webhooks.PostReceive(call))
+	assert.Equal(t, []string{"key-1"}, pushers())
+
+	time.Sleep(time.Millisecond)
+	deletion.User = "alice"
+	require.NoError(t, webhooks.PostReceive(call))
+	assert.Equal(t, []string{"key-1", "alice"}, pushers())
+
+	// Commits are listed with the git binary of the server
+	update := &HookInfo{Ref: "refs/heads/master", OldRev: ZeroSHA, NewRev: testNewRev, RepoPath: t.TempDir()}
+	err := webhooks.PostReceive(&HookCall{RepoName: "test.git", Updates: []*HookInfo{update}, GitPath: "/nonexistent/git"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/nonexistent/git")
+}
+
+func TestWebhooksPush(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	webhooks := &Webhooks{Dir: t.TempDir(), Hooks: []Webhook{{URL: ts.URL, Secret: "secret"}}, Logger: testLogger}
+	require.NoError(t, webhooks.Start())
+	defer webhooks.Stop()
+
+	server, git := newTestServer(t, Config{
+		AutoCreate:    true,
+		AutoHooks:     true,
+		HookCallbacks: &HookCallbacks{PostReceive: webhooks.PostReceive},
+	})
+	t.Cleanup(func() { server.hooks.close() })
+	url := git.URL + "/org/test.git"
+
+	work := newWorkTree(t)
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Second commit\n\nWith details")
+	mustGit(t, work, "tag", "v1")
+	_, stderr, err := runGit(t, work, nil, "push", url, "master", "v1")
+	require.NoError(t, err, stderr)
+
+	waitDeliveries(t, webhooks, 1)
+	receiver.mu.Lock()
+	payload := receiver.payloads[0]
+	receiver.mu.Unlock()
+
+	event := PushEvent{}
+	require.NoError(t, json.Unmarshal(payload, &event))
+	assert.Equal(t, "org/test.git", event.Repo)
+	require.Len(t, event.Refs, 2, string(payload))
+
+	head := strings.TrimSpace(mustGit(t, work, "rev-parse", "master"))
+	master := event.Refs[0]
+	assert.Equal(t, "refs/heads/master", master.Ref)
+	assert.Equal(t, BranchCreateAction, master.Action)
+	assert.Equal(t, ZeroSHA, master.Before)
+	assert.Equal(t, head, master.After)
+	require.Len(t, master.Commits, 2)
+	assert.Equal(t, head, master.Commits[0].ID)
+	assert.Equal(t, "Second commit\n\nWith details", master.Commits[0].Message)
+	assert.Equal(t, "gitkit", master.Commits[0].Author)
+	assert.Equal(t, "gitkit@localhost", master.Commits[0].Email)
+	assert.Equal(t, "Initial commit", master.Commits[1].Message)
+	assert.Equal(t, TagCreateAction, event.Refs[1].Action)
+
+	mustGit(t, work, "commit", "--allow-empty", "-m", "Third commit")
+	_, stderr, err = runGit(t, work, nil, "push", url, "master")
+	require.NoError(t, err, stderr)
+
+	waitDeliveries(t, webhooks, 2)
+	receiver.mu.Lock()
+	payload = receiver.payloads[1]
+	receiver.mu.Unlock()
+
+	require.NoError(t, json.Unmarshal(payload, &event))
+	require.Len(t, event.Refs, 1)
+	assert.Equal(t, BranchPushAction, event.Refs[0].Action)
+	require.Len(t, event.Refs[0].Commits, 1)
+	assert.Equal(t, "Third commit", event.Refs[0].Commits[0].Message)
+}